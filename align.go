@@ -0,0 +1,118 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// commentAligner holds rendered text and the offsets of the trailing
+// comments within it, so that the comments ending consecutive lines may
+// be aligned in the manner of gofmt's use of text/tabwriter.
+type commentAligner struct {
+	buf    bytes.Buffer
+	indent string // string repeated to indent lines
+
+	// comments holds the offsets in buf of the space preceding
+	// each trailing comment, in order.
+	comments []int
+}
+
+func (a *commentAligner) Write(p []byte) (int, error) {
+	return a.buf.Write(p)
+}
+
+// mark records that the last n bytes written are a trailing comment,
+// including the space preceding it.
+func (a *commentAligner) mark(n int) {
+	a.comments = append(a.comments, a.buf.Len()-n)
+}
+
+// alignedLine is a line of the text with a trailing comment.
+type alignedLine struct {
+	indent, code, comment string
+}
+
+// WriteTo writes the text to w with the trailing comments aligned. The
+// comments of a block of consecutive lines that each end with a comment
+// and share the same indentation are aligned one space after the longest
+// code in the block, measured in runes. Lines with different indentation
+// are not aligned with each other since the width of the indent string,
+// such as a tab, may not be known.
+func (a *commentAligner) WriteTo(w io.Writer) (int64, error) {
+	text := a.buf.String()
+	var (
+		out   strings.Builder
+		block []alignedLine
+	)
+	flush := func() {
+		width := 0
+		for _, l := range block {
+			width = max(width, utf8.RuneCountInString(l.code))
+		}
+		for _, l := range block {
+			out.WriteString(l.indent)
+			out.WriteString(l.code)
+			out.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(l.code)+1))
+			out.WriteString(l.comment)
+		}
+		block = block[:0]
+	}
+	comments := a.comments
+	start := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		end := start + len(line)
+		// Skip any further comments on earlier lines.
+		for len(comments) != 0 && comments[0] < start {
+			comments = comments[1:]
+		}
+		var l alignedLine
+		if len(comments) != 0 && comments[0] < end {
+			code := line[:comments[0]-start]
+			l.indent = a.indentation(code)
+			l.code = strings.TrimRight(code[len(l.indent):], " ")
+			l.comment = strings.TrimLeft(line[len(code):], " ")
+		}
+		start = end
+		if l.code == "" {
+			flush()
+			out.WriteString(line)
+			continue
+		}
+		if len(block) != 0 && block[0].indent != l.indent {
+			flush()
+		}
+		block = append(block, l)
+	}
+	flush()
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+// indentation returns the indentation of the line starting with code,
+// which is a repetition of the indent string.
+func (a *commentAligner) indentation(code string) string {
+	n := 0
+	for a.indent != "" && strings.HasPrefix(code[n:], a.indent) {
+		n += len(a.indent)
+	}
+	return code[:n]
+}
@@ -0,0 +1,616 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mailgun/raymond/v2/ast"
+	"github.com/mailgun/raymond/v2/parser"
+
+	"github.com/elastic/celfmt"
+)
+
+type visitor struct {
+	src      string // the complete template
+	keys     []string
+	claimed  int // end of the last field found
+	edits    []edit
+	n        int // number of program fields seen so far
+	cfg      *config
+	mode     mode
+	extract  bool
+	warnings []warning
+
+	// simplifications holds the simplifications applied to the
+	// programs at their positions in the template.
+	simplifications []celfmt.Simplification
+
+	err error
+}
+
+func (v *visitor) warnf(line int, format string, args ...any) {
+	v.warnings = append(v.warnings, warning{line: line, msg: fmt.Sprintf(format, args...)})
+}
+
+// warning is a problem with an input that did not prevent it from being
+// formatted.
+type warning struct {
+	line, col int // 1-based position in the input, or zero if not known
+	msg       string
+}
+
+func (w warning) String() string {
+	switch {
+	case w.line <= 0:
+		return w.msg
+	case w.col <= 0:
+		return fmt.Sprintf("line %d: %s", w.line, w.msg)
+	default:
+		return fmt.Sprintf("line %d:%d: %s", w.line, w.col, w.msg)
+	}
+}
+
+// droppedComment returns the warning for a comment that could not be
+// placed in the formatted program.
+func droppedComment(c celfmt.DroppedComment) warning {
+	return warning{line: c.Line, col: c.Column, msg: "comment could not be placed: " + c.Text}
+}
+
+// edit is a replacement of the template text in [pos, end) with text.
+type edit struct {
+	pos, end int
+	text     string
+}
+
+// applyEdits returns src with all edits applied. Edits must not overlap.
+func applyEdits(src string, edits []edit) string {
+	slices.SortFunc(edits, func(a, b edit) int {
+		return cmp.Compare(a.pos, b.pos)
+	})
+	var buf strings.Builder
+	var last int
+	for _, e := range edits {
+		buf.WriteString(src[last:e.pos])
+		buf.WriteString(e.text)
+		last = e.end
+	}
+	buf.WriteString(src[last:])
+	return buf.String()
+}
+
+// templateParseError matches the position prefix of errors returned by
+// the handlebars parser.
+var templateParseError = regexp.MustCompile(`^Parse error on line (\d+):\n`)
+
+// parseTemplate parses the handlebars template in src. Failures are
+// returned as a *celfmt.Error with the template error kind holding the
+// line of the error if it is known.
+func parseTemplate(src string) (prog *ast.Program, err error) {
+	defer func() {
+		// The parser panics on runtime errors rather than returning
+		// them. A template that trips the parser must not prevent
+		// other inputs from being formatted.
+		if r := recover(); r != nil {
+			err = &celfmt.Error{Kind: celfmt.TemplateError, Err: fmt.Errorf("%v", r)}
+		}
+	}()
+	prog, err = parser.Parse(src)
+	if err != nil {
+		e := &celfmt.Error{Kind: celfmt.TemplateError}
+		msg := err.Error()
+		if m := templateParseError.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			msg = msg[len(m[0]):]
+		}
+		e.Err = errors.New(strings.ReplaceAll(msg, "\n", ": "))
+		return nil, e
+	}
+	return prog, nil
+}
+
+func (v *visitor) VisitProgram(node *ast.Program) any {
+	for _, n := range node.Body {
+		n.Accept(v)
+	}
+	return nil
+}
+
+func (v *visitor) VisitContent(s *ast.ContentStatement) any {
+	// Use the original text rather than the value so that offsets
+	// are offsets into the template. Programs may contain handlebars
+	// expressions, so skip any part of the content that is within a
+	// program that has already been found. If the content does not
+	// start at the beginning of a line the first line cannot be a
+	// field, so skip it.
+	pos := max(s.Pos, v.claimed)
+	end := s.Pos + len(s.Original)
+	if pos != 0 && pos < end && v.src[pos-1] != '\n' {
+		i := strings.IndexByte(v.src[pos:end], '\n')
+		if i < 0 {
+			return nil
+		}
+		pos += i + 1
+	}
+	if pos >= end {
+		return nil
+	}
+	for _, p := range findProgramsYAML(v.src, pos, end) {
+		v.claimed = p.end
+		if !matchKey(v.keys, p.key, yamlPath(v.src, p.start, p.key)) {
+			continue
+		}
+		line := s.Line + strings.Count(v.src[s.Pos:p.start], "\n")
+		switch p.style {
+		case '|':
+		case '>':
+			v.warnf(line, "cannot format %s field in folded block scalar", unquote(p.key))
+			continue
+		default:
+			v.warnf(line, "cannot format %s field that is not a literal block scalar", unquote(p.key))
+			continue
+		}
+		v.n++
+		program, rep, err := celFmtYAML(p, v.cfg, v.mode, v.extract)
+		if err != nil {
+			substituted := p.substitutionError(err)
+			err = p.templateErrors(err, line)
+			if substituted {
+				// Handlebars expressions can make a program
+				// invalid until it is rendered, so this is not
+				// necessarily an error in the template.
+				v.warnf(line, "did not format templated program %d: %v", v.n, err)
+				continue
+			}
+			v.err = errors.Join(v.err, err)
+			continue
+		}
+		for _, a := range rep.Simplifications {
+			a.Line, a.Column = p.templatePos(line, a.Line, a.Column)
+			v.simplifications = append(v.simplifications, a)
+		}
+		for _, c := range rep.DroppedComments {
+			c.Line, c.Column = p.templatePos(line, c.Line, c.Column)
+			v.warnings = append(v.warnings, droppedComment(c))
+		}
+		if v.extract {
+			program += "\n"
+		}
+		v.edits = append(v.edits, edit{
+			pos:  p.start + p.col,
+			end:  p.end,
+			text: program,
+		})
+	}
+	return nil
+}
+
+// VisitBlock visits the program and inverse of any block helper. Chained
+// inverses, {{else if ...}}, are represented as a block in the inverse.
+func (v *visitor) VisitBlock(s *ast.BlockStatement) any {
+	if s.Program != nil {
+		s.Program.Accept(v)
+	}
+	if s.Inverse != nil {
+		s.Inverse.Accept(v)
+	}
+	return nil
+}
+
+func (v *visitor) VisitPartial(s *ast.PartialStatement) any {
+	name, _ := ast.HelperNameStr(s.Name)
+	v.warnf(s.Line, "cannot format programs in partial %s", name)
+	return nil
+}
+
+// ¯\_(ツ)_/¯
+func (v *visitor) VisitMustache(*ast.MustacheStatement) any  { return nil }
+func (v *visitor) VisitComment(*ast.CommentStatement) any    { return nil }
+func (v *visitor) VisitExpression(*ast.Expression) any       { return nil }
+func (v *visitor) VisitSubExpression(*ast.SubExpression) any { return nil }
+func (v *visitor) VisitPath(*ast.PathExpression) any         { return nil }
+func (v *visitor) VisitString(*ast.StringLiteral) any        { return nil }
+func (v *visitor) VisitBoolean(*ast.BooleanLiteral) any      { return nil }
+func (v *visitor) VisitNumber(*ast.NumberLiteral) any        { return nil }
+func (v *visitor) VisitHash(*ast.Hash) any                   { return nil }
+func (v *visitor) VisitHashPair(*ast.HashPair) any           { return nil }
+
+// celFmtYAML returns the formatted text of the program p, either as its
+// field in the template or, if extract is true, as the bare program, along
+// with the report of the changes made to it at their positions in the
+// program.
+func celFmtYAML(p yamlProgram, cfg *config, m mode, extract bool) (string, celfmt.Report, error) {
+	var vars []string
+	for _, t := range p.tmpl {
+		if !t.line {
+			vars = append(vars, t.placeholder)
+		}
+	}
+	var buf strings.Builder
+	rep, err := celFmt(&buf, p.text, cfg, m, vars...)
+	if err != nil {
+		return "", rep, err
+	}
+	formatted := buf.String()
+	restore := make([]string, 0, 2*len(p.tmpl))
+	lines := make(map[string]string)
+	for _, t := range p.tmpl {
+		if n := strings.Count(formatted, t.placeholder); n != 1 {
+			return "", rep, fmt.Errorf("%w %s", errPlaceholder, t.text)
+		}
+		if t.line {
+			lines["// "+t.placeholder] = t.text
+		} else {
+			restore = append(restore, t.placeholder, t.text)
+		}
+	}
+	// The formatter may move comments, and so standalone lines, to
+	// other places in the program, changing what the template means.
+	want, got := lineAnchors(p.text), lineAnchors(formatted)
+	for _, t := range p.tmpl {
+		if t.line && want[t.placeholder] != got[t.placeholder] {
+			return "", rep, fmt.Errorf("%w %s in place", errPlaceholder, strings.TrimSpace(t.text))
+		}
+	}
+	r := strings.NewReplacer(restore...)
+	if extract {
+		formatted = r.Replace(formatted)
+		for c, l := range lines {
+			formatted = strings.Replace(formatted, c, strings.TrimSpace(l), 1)
+		}
+		return formatted, rep, nil
+	}
+	// We should be able to do this properly, but there is no
+	// non-buggy YAML library that will not double-quote some
+	// programs. Retain the original header so that the block
+	// indicators and the content indentation are unchanged.
+	// Chomping is preserved since trailing blank lines are not
+	// part of the edit.
+	pad := strings.Repeat(" ", p.indent)
+	out := strings.Split(formatted, "\n")
+	for i, l := range out {
+		if orig, ok := lines[strings.TrimSpace(l)]; ok {
+			out[i] = orig
+		} else if l != "" {
+			out[i] = pad + r.Replace(l)
+		}
+	}
+	return p.key + ": " + p.header + "\n" + strings.Join(out, "\n") + "\n", rep, nil
+}
+
+// errPlaceholder is the error returned when the handlebars expressions of a
+// program could not be restored to its formatted text.
+var errPlaceholder = errors.New("could not retain handlebars expression")
+
+// substitutionError returns whether err, returned by celFmtYAML for the
+// program, may be caused by the placeholders substituted for its handlebars
+// expressions rather than by the program itself. Syntax errors at or after
+// the first placeholder may be, since handlebars expressions can make a
+// program invalid until the template is rendered. Type-checking errors are
+// not, since placeholders are declared as dynamically typed variables.
+func (p yamlProgram) substitutionError(err error) bool {
+	if len(p.tmpl) == 0 {
+		return false
+	}
+	if errors.Is(err, errPlaceholder) {
+		return true
+	}
+	// Positions of errors are 1-based.
+	row, col := p.tmpl[0].row+1, p.tmpl[0].col+1
+	var parse, other bool
+	walkErrors(err, func(e *celfmt.Error) {
+		if e.Kind == celfmt.ParseError && (e.Line > row || e.Line == row && e.Column >= col || e.Line <= 0) {
+			parse = true
+		} else {
+			other = true
+		}
+	})
+	return parse && !other
+}
+
+// lineAnchors returns the code tokens before and after each standalone line
+// placeholder comment in the program text, keyed by placeholder. Commas are
+// ignored since the formatter may add a trailing comma, and string literals
+// stand for themselves only by their presence since their quoting may be
+// changed.
+func lineAnchors(text string) map[string][2]string {
+	anchors := make(map[string][2]string)
+	var (
+		prev    string   // last code token
+		pending []string // placeholders awaiting the next code token
+	)
+	for _, tok := range celfmt.Tokens(text) {
+		switch {
+		case tok.Comment:
+			p := strings.TrimSpace(strings.TrimPrefix(tok.Text, "//"))
+			if strings.HasPrefix(p, placeholderPrefix) {
+				anchors[p] = [2]string{prev, ""}
+				pending = append(pending, p)
+			}
+			continue
+		case tok.Text == ",":
+			continue
+		case strings.HasPrefix(strings.TrimLeft(tok.Text, "rRbB"), `"`),
+			strings.HasPrefix(strings.TrimLeft(tok.Text, "rRbB"), "'"):
+			tok.Text = `""`
+		}
+		for _, p := range pending {
+			anchors[p] = [2]string{anchors[p][0], tok.Text}
+		}
+		pending = pending[:0]
+		prev = tok.Text
+	}
+	return anchors
+}
+
+// yamlProgram is a scalar field found in a template.
+type yamlProgram struct {
+	start, end int  // byte offsets of the field's lines
+	col        int  // column of the field's key
+	indent     int  // indentation of the block scalar's content
+	style      byte // '|' or '>' for block scalars, otherwise zero
+	key        string
+	header     string     // the block scalar header including any comment
+	text       string     // the decoded value
+	tmpl       []tmplExpr // handlebars expressions replaced in text
+}
+
+// tmplExpr is a handlebars expression in a program that has been
+// replaced with a placeholder to allow the program to be formatted.
+// Expressions within a line are replaced with an identifier and
+// standalone lines are replaced with a comment.
+type tmplExpr struct {
+	placeholder string
+	text        string // the expression, or the complete line
+	line        bool
+	row, col    int // position of the placeholder in the program text
+}
+
+var (
+	// keyLine matches a YAML mapping key at the start of a line, possibly
+	// within a sequence entry. The submatches are the key's indentation,
+	// any sequence entry indicators, the key and the remainder of the line.
+	keyLine = regexp.MustCompile(`^( *)((?:- +)*)("[^"]*"|'[^']*'|[A-Za-z0-9_$][^\s:#]*):(?:[ \t]+(.*))?$`)
+
+	// blockHeader matches the header of a block scalar. The submatches
+	// are the block style indicator and the chomping and indentation
+	// indicators.
+	blockHeader = regexp.MustCompile(`^([|>])([1-9]?[-+]?|[-+][1-9])?(?:[ \t]+#.*)?$`)
+
+	// mustache matches a handlebars expression.
+	mustache = regexp.MustCompile(`\{\{\{?[^}]*\}?\}\}`)
+
+	// standaloneLine matches a line holding only a handlebars block,
+	// else, comment or partial expression. Handlebars removes these
+	// lines from the rendered template.
+	standaloneLine = regexp.MustCompile(`^[ \t]*\{\{~?(?:[#/^!>]|else\b)[^}]*\}\}[ \t]*$`)
+)
+
+// findProgramsYAML returns all the fields in src that hold a block scalar
+// or a plain or quoted scalar and start in [pos, end), in order. Only literal
+// block scalars have their extent and value populated and their extent may
+// go beyond end. Fields holding a handlebars expression are not included.
+// The pos offset must be at the beginning of a line.
+func findProgramsYAML(src string, pos, end int) []yamlProgram {
+	var (
+		programs []yamlProgram
+		cur      *yamlProgram
+		last     int // end of the last non-blank line of cur
+		explicit bool
+	)
+	for pos < len(src) && (pos < end || cur != nil) {
+		line, _, _ := strings.Cut(src[pos:], "\n")
+		next := min(pos+len(line)+1, len(src))
+		if cur != nil {
+			trimmed := strings.TrimLeft(line, " ")
+			width := len(line) - len(trimmed)
+			switch {
+			case strings.TrimSpace(line) == "", standaloneLine.MatchString(line):
+				// Blank lines may be part of the value and standalone
+				// handlebars lines are not in the rendered YAML.
+				pos = next
+				continue
+			case cur.indent == 0 && !explicit && width > cur.col:
+				cur.indent = width
+			}
+			if cur.indent != 0 && width >= cur.indent {
+				last = next
+				pos = next
+				continue
+			}
+			programs = appendProgram(programs, cur, src, last)
+			cur = nil
+			if pos >= end {
+				break
+			}
+		}
+		m := keyLine.FindStringSubmatch(line)
+		if m != nil {
+			col := len(m[1]) + len(m[2])
+			h := blockHeader.FindStringSubmatch(m[4])
+			switch {
+			case h != nil && h[1] == "|":
+				cur = &yamlProgram{start: pos, col: col, style: '|', key: m[3], header: m[4]}
+				last = next
+				explicit = false
+				if i := strings.IndexAny(h[2], "123456789"); i >= 0 {
+					cur.indent = col + int(h[2][i]-'0')
+					explicit = true
+				}
+			case h != nil:
+				programs = append(programs, yamlProgram{start: pos, end: next, col: col, style: h[1][0], key: m[3]})
+			case m[4] != "" && !strings.HasPrefix(m[4], "{{") && !strings.HasPrefix(m[4], "#"):
+				programs = append(programs, yamlProgram{start: pos, end: next, col: col, key: m[3]})
+			}
+		}
+		pos = next
+	}
+	if cur != nil {
+		programs = appendProgram(programs, cur, src, last)
+	}
+	return programs
+}
+
+// appendProgram completes the program p which ends at end in src, appending
+// it to programs if it has any content. Handlebars expressions in the value
+// are replaced with placeholders.
+func appendProgram(programs []yamlProgram, p *yamlProgram, src string, end int) []yamlProgram {
+	p.end = end
+	if p.indent == 0 {
+		// Empty value.
+		return programs
+	}
+	_, body, _ := strings.Cut(src[p.start:p.end], "\n")
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	for i, l := range lines {
+		switch {
+		case standaloneLine.MatchString(l):
+			t := tmplExpr{placeholder: placeholder(len(p.tmpl)), text: l, line: true, row: i}
+			p.tmpl = append(p.tmpl, t)
+			lines[i] = "// " + t.placeholder
+			continue
+		case len(l) < p.indent:
+			lines[i] = ""
+			continue
+		}
+		l = l[p.indent:]
+		var buf strings.Builder
+		var last int
+		for _, m := range mustache.FindAllStringIndex(l, -1) {
+			buf.WriteString(l[last:m[0]])
+			t := tmplExpr{
+				placeholder: placeholder(len(p.tmpl)),
+				text:        l[m[0]:m[1]],
+				row:         i,
+				col:         utf8.RuneCountInString(buf.String()),
+			}
+			p.tmpl = append(p.tmpl, t)
+			buf.WriteString(t.placeholder)
+			last = m[1]
+		}
+		buf.WriteString(l[last:])
+		lines[i] = buf.String()
+	}
+	p.text = strings.Join(lines, "\n")
+	return append(programs, *p)
+}
+
+// templateErrors returns err with the positions of the errors it holds,
+// which are positions in the program text, mapped to positions in the
+// template given the line of the program's field.
+func (p yamlProgram) templateErrors(err error, line int) error {
+	walkErrors(err, func(e *celfmt.Error) {
+		if e.Line <= 0 {
+			return
+		}
+		e.Line, e.Column = p.templatePos(line, e.Line, e.Column)
+	})
+	return err
+}
+
+// templatePos returns the 1-based position in the template of the 1-based
+// position row, col in the program text given the line of the program's
+// field. A col of zero is retained as an unknown column.
+func (p yamlProgram) templatePos(line, row, col int) (int, int) {
+	row--
+	col--
+	if col >= 0 {
+		// Account for the difference in length between
+		// handlebars expressions and their placeholders.
+		shift := 0
+		for _, t := range p.tmpl {
+			if !t.line && t.row == row && t.col < col {
+				shift += utf8.RuneCountInString(t.text) - len(t.placeholder)
+			}
+		}
+		col = p.indent + col + shift
+	}
+	return line + 1 + row, col + 1
+}
+
+// placeholderPrefix is the prefix of the identifiers standing in for
+// handlebars expressions.
+const placeholderPrefix = "__celfmt_tmpl_"
+
+func placeholder(n int) string {
+	return fmt.Sprintf(placeholderPrefix+"%d__", n)
+}
+
+// yamlPath returns the dotted path to the key found on the line starting
+// at pos in src, ignoring sequence entries.
+func yamlPath(src string, pos int, key string) string {
+	m := keyLine.FindStringSubmatch(strings.SplitN(src[pos:], "\n", 2)[0])
+	if m == nil {
+		return key
+	}
+	threshold := len(m[1]) + len(m[2])
+	if m[2] != "" {
+		threshold = len(m[1]) + 1
+	}
+	path := []string{unquote(key)}
+	for pos > 0 && threshold > 0 {
+		start := strings.LastIndexByte(src[:pos-1], '\n') + 1
+		line := src[start : pos-1]
+		pos = start
+		m := keyLine.FindStringSubmatch(line)
+		if m == nil {
+			trimmed := strings.TrimLeft(line, " ")
+			if width := len(line) - len(trimmed); strings.HasPrefix(trimmed, "- ") && width < threshold {
+				// Sequence entry holding a scalar or mustache.
+				threshold = width + 1
+			}
+			continue
+		}
+		col := len(m[1]) + len(m[2])
+		if col < threshold {
+			path = append(path, unquote(m[3]))
+			threshold = col
+		}
+		if m[2] != "" && len(m[1]) < threshold {
+			threshold = len(m[1]) + 1
+		}
+	}
+	slices.Reverse(path)
+	return strings.Join(path, ".")
+}
+
+func unquote(key string) string {
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		return key[1 : len(key)-1]
+	}
+	return key
+}
+
+// matchKey returns whether the field named key at the dotted path
+// is selected by any of the keys or paths in sel.
+func matchKey(sel []string, key, path string) bool {
+	key = unquote(key)
+	for _, s := range sel {
+		if s == key || s == path {
+			return true
+		}
+	}
+	return false
+}
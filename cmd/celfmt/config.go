@@ -0,0 +1,543 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/operators"
+	"gopkg.in/yaml.v3"
+
+	"github.com/elastic/celfmt"
+	"github.com/elastic/celfmt/profiles"
+)
+
+// configName is the name of the project configuration file.
+const configName = ".celfmt.yaml"
+
+// config holds the formatting settings that may be given in a configuration
+// file or by command-line flags. Unset fields take the default for the
+// formatting mode.
+type config struct {
+	Indent         *string  `yaml:"indent,omitempty"`
+	WrapColumn     *int     `yaml:"wrap_column,omitempty"`
+	WrapOperators  []string `yaml:"wrap_operators,omitempty"`
+	WrapAfter      *bool    `yaml:"wrap_after,omitempty"`
+	Layout         *string  `yaml:"layout,omitempty"`
+	TrailingComma  *bool    `yaml:"trailing_comma,omitempty"`
+	StrictComments *bool    `yaml:"strict_comments,omitempty"`
+	AlignComments  *bool    `yaml:"align_comments,omitempty"`
+	Simplify       *bool    `yaml:"simplify,omitempty"`
+	Check          *bool    `yaml:"check,omitempty"`
+	Env            *string  `yaml:"env,omitempty"`          // environment profile, overriding the declarations' profile
+	Declarations   *string  `yaml:"declarations,omitempty"` // declarations file, relative to the configuration file
+	Variables      []string `yaml:"variables,omitempty"`    // dynamically typed variables added to the environment
+	Keys           []string `yaml:"keys,omitempty"`         // fields holding programs in agent mode
+
+	path  string               // file the configuration was read from, if any
+	decls *celfmt.Declarations // declarations loaded from Declarations
+
+	// formatters holds the Formatters built for the configuration,
+	// which are shared by the inputs formatted with it.
+	formatters *formatters
+}
+
+// formatters caches Formatters by the mode and the placeholder variables
+// of the programs they format, so that the environment of a configuration
+// is only built once for each.
+type formatters struct {
+	mu sync.Mutex
+	m  map[formatterKey]*formatterEntry
+}
+
+type formatterKey struct {
+	mode mode
+	vars string // placeholder variables, sorted and joined by commas
+}
+
+type formatterEntry struct {
+	once sync.Once
+	f    *celfmt.Formatter
+	err  error
+}
+
+// formatter returns the Formatter for programs in the mode m that use the
+// placeholder variables vars. It is safe for concurrent use.
+func (cfg *config) formatter(m mode, vars []string) (*celfmt.Formatter, error) {
+	c := cfg.formatters
+	if c == nil {
+		// The configuration is not shared.
+		return cfg.newFormatter(m, vars)
+	}
+	key := formatterKey{mode: m, vars: strings.Join(slices.Sorted(slices.Values(vars)), ",")}
+	c.mu.Lock()
+	e, ok := c.m[key]
+	if !ok {
+		if c.m == nil {
+			c.m = make(map[formatterKey]*formatterEntry)
+		}
+		e = &formatterEntry{}
+		c.m[key] = e
+	}
+	c.mu.Unlock()
+	e.once.Do(func() {
+		e.f, e.err = cfg.newFormatter(m, vars)
+	})
+	return e.f, e.err
+}
+
+// newFormatter returns a Formatter for programs in the mode m that use the
+// placeholder variables vars.
+func (cfg *config) newFormatter(m mode, vars []string) (*celfmt.Formatter, error) {
+	opts, err := cfg.formatOptions(m)
+	if err != nil {
+		return nil, err
+	}
+	decls := cfg.declarations()
+	var varOpts []cel.EnvOption
+	for _, v := range slices.Concat(cfg.Variables, vars) {
+		if _, ok := decls.Variables[v]; ok {
+			continue
+		}
+		varOpts = append(varOpts, cel.Variable(v, cel.DynType))
+	}
+	return celfmt.NewFormatter(celfmt.Options{
+		Declarations: decls,
+		EnvOptions:   varOpts,
+		Check:        cfg.check(),
+		Simplify:     cfg.simplify(),
+		Format:       opts,
+	})
+}
+
+// loadConfig reads a configuration from the YAML file at path. Unknown
+// fields are an error.
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	cfg := config{path: path}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(&cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not parse config %s: %w", path, err)
+	}
+	if cfg.Declarations != nil && !filepath.IsAbs(*cfg.Declarations) {
+		decls := filepath.Join(filepath.Dir(path), *cfg.Declarations)
+		cfg.Declarations = &decls
+	}
+	return &cfg, nil
+}
+
+// setFlags sets the fields of cfg for each configuration flag that was set
+// on the command line.
+func (cfg *config) setFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		switch f.Name {
+		case "indent":
+			var indent string
+			indent, err = strconv.Unquote(`"` + v.(string) + `"`)
+			if err != nil {
+				err = fmt.Errorf("invalid indent %q: %w", v, err)
+				return
+			}
+			cfg.Indent = &indent
+		case "wrap-column":
+			col := v.(int)
+			cfg.WrapColumn = &col
+		case "wrap-operators":
+			cfg.WrapOperators = strings.Split(v.(string), ",")
+		case "wrap-after":
+			after := v.(bool)
+			cfg.WrapAfter = &after
+		case "layout":
+			layout := v.(string)
+			cfg.Layout = &layout
+		case "trailing-comma":
+			comma := v.(bool)
+			cfg.TrailingComma = &comma
+		case "strict-comments":
+			strict := v.(bool)
+			cfg.StrictComments = &strict
+		case "align-comments":
+			align := v.(bool)
+			cfg.AlignComments = &align
+		case "s":
+			simplify := v.(bool)
+			cfg.Simplify = &simplify
+		case "check":
+			check := v.(bool)
+			cfg.Check = &check
+		case "env":
+			env := v.(string)
+			cfg.Env = &env
+		case "decls":
+			decls := v.(string)
+			cfg.Declarations = &decls
+		case "keys":
+			cfg.Keys = strings.Split(v.(string), ",")
+		}
+	})
+	return err
+}
+
+// merge returns a copy of cfg with the fields that are set in o replacing
+// those in cfg.
+func (cfg *config) merge(o *config) *config {
+	c := *cfg
+	c.formatters = nil
+	if o.Indent != nil {
+		c.Indent = o.Indent
+	}
+	if o.WrapColumn != nil {
+		c.WrapColumn = o.WrapColumn
+	}
+	if o.WrapOperators != nil {
+		c.WrapOperators = o.WrapOperators
+	}
+	if o.WrapAfter != nil {
+		c.WrapAfter = o.WrapAfter
+	}
+	if o.Layout != nil {
+		c.Layout = o.Layout
+	}
+	if o.TrailingComma != nil {
+		c.TrailingComma = o.TrailingComma
+	}
+	if o.StrictComments != nil {
+		c.StrictComments = o.StrictComments
+	}
+	if o.AlignComments != nil {
+		c.AlignComments = o.AlignComments
+	}
+	if o.Simplify != nil {
+		c.Simplify = o.Simplify
+	}
+	if o.Check != nil {
+		c.Check = o.Check
+	}
+	if o.Env != nil {
+		c.Env = o.Env
+	}
+	if o.Declarations != nil {
+		c.Declarations = o.Declarations
+	}
+	if o.Variables != nil {
+		c.Variables = o.Variables
+	}
+	if o.Keys != nil {
+		c.Keys = o.Keys
+	}
+	return &c
+}
+
+// effective returns a copy of cfg with unset fields holding their default
+// values for the mode m. The environment profile is that of the resolved
+// declarations, and programs are type-checked if the declarations require
+// it.
+func (cfg *config) effective(m mode) *config {
+	indent := "\t"
+	if m == agentMode {
+		indent = "  "
+	}
+	col := 80
+	after := true
+	layout := "source"
+	comma := true
+	strict := false
+	align := true
+	simplify := false
+	check := false
+	c := (&config{
+		Indent:         &indent,
+		WrapColumn:     &col,
+		WrapOperators:  []string{"&&", "||"},
+		WrapAfter:      &after,
+		Layout:         &layout,
+		TrailingComma:  &comma,
+		StrictComments: &strict,
+		AlignComments:  &align,
+		Simplify:       &simplify,
+		Check:          &check,
+		Keys:           []string{"program"},
+		path:           cfg.path,
+		decls:          cfg.decls,
+	}).merge(cfg)
+	env := cmp.Or(c.declarations().Profile, profiles.Mito)
+	c.Env = &env
+	if c.decls != nil && c.decls.Check {
+		required := true
+		c.Check = &required
+	}
+	return c
+}
+
+// simplify returns whether expressions should be simplified.
+func (cfg *config) simplify() bool {
+	return cfg.Simplify != nil && *cfg.Simplify
+}
+
+// check returns whether programs should be type-checked.
+func (cfg *config) check() bool {
+	return cfg.Check != nil && *cfg.Check
+}
+
+// declarations returns the declarations of the environment programs are
+// formatted in.
+func (cfg *config) declarations() *celfmt.Declarations {
+	d := &celfmt.Declarations{}
+	if cfg.decls != nil {
+		*d = *cfg.decls
+	}
+	if cfg.Env != nil {
+		d.Profile = *cfg.Env
+	}
+	return d
+}
+
+// keys returns the fields holding programs in agent mode.
+func (cfg *config) keys() []string {
+	if cfg.Keys == nil {
+		return []string{"program"}
+	}
+	return cfg.Keys
+}
+
+// configs resolves the configuration for each input.
+type configs struct {
+	file     *config                         // configuration named by -config, if any
+	flags    *config                         // settings given on the command line
+	found    map[string]*config              // discovered configurations by directory
+	resolved map[*config]*config             // configurations for inputs by their base
+	decls    map[string]*celfmt.Declarations // loaded declarations by path
+}
+
+// forPath returns the configuration for the input at path, or for the
+// standard input if path is empty. Unless a configuration was given with
+// -config, the nearest configuration file found in the directories from the
+// input's directory up to the root of the repository holding it is used.
+// Flags take precedence over settings in the configuration file.
+func (c *configs) forPath(path string) (*config, error) {
+	base := c.file
+	if base == nil {
+		dir := "."
+		if path != "" {
+			dir = filepath.Dir(path)
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		base, err = c.find(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg, ok := c.resolved[base]; ok {
+		return cfg, nil
+	}
+	cfg := base.merge(c.flags)
+	_, err := cfg.formatOptions(celMode)
+	if err == nil && cfg.Env != nil && !slices.Contains(profiles.Names(), *cfg.Env) {
+		err = fmt.Errorf("unknown profile: %s", *cfg.Env)
+	}
+	if err == nil && cfg.Declarations != nil {
+		cfg.decls, err = c.loadDeclarations(*cfg.Declarations)
+	}
+	if err != nil {
+		if cfg.path != "" {
+			err = fmt.Errorf("%s: %w", cfg.path, err)
+		}
+		return nil, err
+	}
+	// Inputs with the same configuration share its Formatters.
+	cfg.formatters = &formatters{}
+	if c.resolved == nil {
+		c.resolved = make(map[*config]*config)
+	}
+	c.resolved[base] = cfg
+	return cfg, nil
+}
+
+// loadDeclarations returns the declarations in the file at path.
+func (c *configs) loadDeclarations(path string) (*celfmt.Declarations, error) {
+	if d, ok := c.decls[path]; ok {
+		return d, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read declarations: %w", err)
+	}
+	d, err := celfmt.ParseDeclarations(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// Catch invalid types and libraries before formatting.
+	_, err = d.NewEnv()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.decls == nil {
+		c.decls = make(map[string]*celfmt.Declarations)
+	}
+	c.decls[path] = d
+	return d, nil
+}
+
+// find returns the nearest configuration in dir or its parents, stopping
+// at the root of the repository holding dir. If there is none, it returns
+// an empty configuration.
+func (c *configs) find(dir string) (*config, error) {
+	if cfg, ok := c.found[dir]; ok {
+		return cfg, nil
+	}
+	if c.found == nil {
+		c.found = make(map[string]*config)
+	}
+	path := filepath.Join(dir, configName)
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		cfg, err := loadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		c.found[dir] = cfg
+		return cfg, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	parent := filepath.Dir(dir)
+	if parent == dir || isRepoRoot(dir) {
+		c.found[dir] = &config{}
+		return c.found[dir], nil
+	}
+	cfg, err := c.find(parent)
+	if err != nil {
+		return nil, err
+	}
+	c.found[dir] = cfg
+	return cfg, nil
+}
+
+// isRepoRoot returns whether dir is the root of a git repository.
+func isRepoRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// printConfig writes the effective configuration for the input name in the
+// mode m to dst.
+func printConfig(dst io.Writer, name string, m mode, cfg *config) error {
+	b, err := yaml.Marshal(cfg.effective(m))
+	if err != nil {
+		return err
+	}
+	if cfg.path != "" {
+		name += ": " + cfg.path
+	}
+	_, err = fmt.Fprintf(dst, "# %s\n%s", name, b)
+	return err
+}
+
+// logicalOperators holds the operators that are not known to operators.Find.
+var logicalOperators = map[string]string{
+	"&&": operators.LogicalAnd,
+	"||": operators.LogicalOr,
+}
+
+// layouts holds the layout modes by name.
+var layouts = map[string]celfmt.LayoutMode{
+	"source":    celfmt.SourceLayout,
+	"width":     celfmt.WidthLayout,
+	"canonical": celfmt.CanonicalLayout,
+}
+
+// formatOptions returns the format options for cfg in the mode m. Invalid
+// settings are reported by the option constructors.
+func (cfg *config) formatOptions(m mode) ([]celfmt.FormatOption, error) {
+	opts := []celfmt.FormatOption{celfmt.Pretty()}
+	if cfg.TrailingComma == nil || *cfg.TrailingComma {
+		opts = append(opts, celfmt.AlwaysComma())
+	}
+	if cfg.Indent != nil {
+		opts = append(opts, celfmt.IndentString(*cfg.Indent))
+	} else if m == agentMode {
+		opts = append(opts, celfmt.IndentString("  "))
+	}
+	if cfg.WrapColumn != nil {
+		opts = append(opts, celfmt.WrapOnColumn(*cfg.WrapColumn))
+	}
+	if cfg.WrapOperators != nil {
+		// The option takes the internal operator names, so translate
+		// from the symbols users write. Unknown symbols are passed
+		// through for the option to reject.
+		ops := make([]string, len(cfg.WrapOperators))
+		for i, sym := range cfg.WrapOperators {
+			sym = strings.TrimSpace(sym)
+			if op, ok := logicalOperators[sym]; ok {
+				sym = op
+			} else if op, ok := operators.Find(sym); ok {
+				sym = op
+			}
+			ops[i] = sym
+		}
+		opts = append(opts, celfmt.WrapOnOperators(ops...))
+	}
+	if cfg.WrapAfter != nil {
+		opts = append(opts, celfmt.WrapAfterColumnLimit(*cfg.WrapAfter))
+	}
+	if cfg.Layout != nil {
+		layout, ok := layouts[*cfg.Layout]
+		if !ok {
+			return nil, fmt.Errorf("unknown layout: %s", *cfg.Layout)
+		}
+		opts = append(opts, celfmt.Layout(layout))
+	}
+	if cfg.StrictComments != nil && *cfg.StrictComments {
+		opts = append(opts, celfmt.StrictComments())
+	}
+	if cfg.AlignComments != nil {
+		opts = append(opts, celfmt.AlignComments(*cfg.AlignComments))
+	}
+	err := celfmt.ValidateOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
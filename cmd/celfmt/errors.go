@@ -0,0 +1,72 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+
+	"github.com/elastic/celfmt"
+)
+
+// walkErrors calls fn for each *celfmt.Error held by err, including those
+// joined by errors.Join.
+func walkErrors(err error, fn func(*celfmt.Error)) {
+	switch err := err.(type) {
+	case nil:
+	case *celfmt.Error:
+		fn(err)
+	case interface{ Unwrap() []error }:
+		for _, e := range err.Unwrap() {
+			walkErrors(e, fn)
+		}
+	default:
+		walkErrors(errors.Unwrap(err), fn)
+	}
+}
+
+// fileError returns err attributed to the input name. The file of each
+// *celfmt.Error held by err is set to name and other errors are prefixed
+// with name.
+func fileError(name string, err error) error {
+	switch e := err.(type) {
+	case *celfmt.Error:
+		e.File = name
+		return e
+	case interface{ Unwrap() []error }:
+		errs := slices.Clone(e.Unwrap())
+		for i, e := range errs {
+			errs[i] = fileError(name, e)
+		}
+		return errors.Join(errs...)
+	default:
+		return fmt.Errorf("%s: %w", name, err)
+	}
+}
+
+// ioError returns err as a *celfmt.Error with the I/O error kind. The
+// path of a *fs.PathError is dropped as it is held by the error's file.
+func ioError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &celfmt.Error{Kind: celfmt.IOError, Err: err}
+}
@@ -0,0 +1,261 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/rogpeppe/go-internal/diff"
+
+	"github.com/elastic/celfmt"
+)
+
+// file is an input file and the mode and configuration to format it with.
+type file struct {
+	path string
+	mode mode
+	cfg  *config
+}
+
+// collectFiles returns the files to format for the given arguments.
+// Directories are walked recursively for .cel and .yml.hbs files,
+// skipping hidden files and directories. Files named explicitly are
+// formatted as CEL programs or agent configurations according to their
+// extension, falling back to the mode def. A file that is reached more
+// than once is only formatted the first time, so that it is not written
+// concurrently.
+func collectFiles(args []string, def mode) ([]file, error) {
+	// Extracting is only meaningful for agent configurations.
+	agent := agentMode
+	if def == extractMode {
+		agent = extractMode
+	}
+	var files []file
+	seen := make(map[string]bool)
+	add := func(path string, m mode) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			files = append(files, file{path: path, mode: m})
+		}
+		return nil
+	}
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			m := def
+			switch ext := filepath.Ext(arg); ext {
+			case ".cel":
+				m = celMode
+			case ".hbs", ".yml", ".yaml":
+				m = agent
+			}
+			err = add(arg, m)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != arg && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch {
+			case d.IsDir():
+			case strings.HasSuffix(path, ".cel"):
+				return add(path, celMode)
+			case strings.HasSuffix(path, ".yml.hbs"):
+				return add(path, agent)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// output describes how results are written.
+type output struct {
+	write  bool   // write results back to files
+	list   bool   // list inputs that need formatting
+	diff   bool   // print diffs for inputs that need formatting
+	format string // report format: text, json or sarif
+}
+
+// report writes the result of formatting the input name from src to
+// formatted to dst according to the output configuration, returning the
+// resulting exit status.
+func (o output) report(dst io.Writer, name, src, formatted string) (int, error) {
+	changed := formatted != src
+	if !o.write && !o.list && !o.diff {
+		_, err := io.WriteString(dst, formatted)
+		return exitOK, err
+	}
+	if !changed {
+		return exitOK, nil
+	}
+	if o.list {
+		_, err := fmt.Fprintln(dst, name)
+		if err != nil {
+			return exitError, err
+		}
+	}
+	if o.diff {
+		_, err := dst.Write(diff.Diff(name+".orig", []byte(src), name, []byte(formatted)))
+		if err != nil {
+			return exitError, err
+		}
+	}
+	if o.write {
+		// The file has been fixed.
+		return exitOK, nil
+	}
+	return exitUnformatted, nil
+}
+
+// result is the outcome of formatting a file.
+type result struct {
+	src             string
+	formatted       string
+	warnings        []warning
+	simplifications []celfmt.Simplification
+	err             error
+}
+
+// formatFiles formats the files concurrently, reporting the results to dst
+// in order and writing them back to the files if requested. Failures are
+// logged, or with a json or sarif report format included in the report, and
+// do not prevent the remaining files from being formatted. It returns the
+// command's exit status.
+func formatFiles(dst io.Writer, files []file, out output) int {
+	results := make([]result, len(files))
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i, f := range files {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			results[i] = formatFile(f, out.write)
+		})
+	}
+	wg.Wait()
+
+	if out.format != textFormat {
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = f.path
+		}
+		return out.writeReport(dst, names, results)
+	}
+	status := exitOK
+	for i, r := range results {
+		path := files[i].path
+		for _, w := range r.warnings {
+			log.Printf("%s: warning: %v", path, w)
+		}
+		if r.err != nil {
+			log.Print(fileError(path, r.err))
+			status = exitError
+			continue
+		}
+		s, err := out.report(dst, path, r.src, r.formatted)
+		if err != nil {
+			log.Printf("could not write output: %v", err)
+			return exitError
+		}
+		if status == exitOK {
+			status = s
+		}
+	}
+	return status
+}
+
+// formatFile formats a single file, writing the result back to the file if
+// write is true and the formatting changed the file.
+func formatFile(f file, write bool) result {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return result{err: ioError(err)}
+	}
+	r := format(string(b), f.mode, f.cfg)
+	if r.err == nil && write && r.formatted != r.src {
+		err = writeFile(f.path, r.formatted)
+		if err != nil {
+			r.err = ioError(err)
+		}
+	}
+	return r
+}
+
+// writeFile atomically replaces the contents of the file at path with data,
+// retaining the file's permissions.
+func writeFile(path, data string) (err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	_, err = f.WriteString(data)
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
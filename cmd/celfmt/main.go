@@ -20,44 +20,154 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
 
-	"github.com/elastic/mito/lib"
-	"github.com/google/cel-go/cel"
-	"github.com/google/cel-go/common"
-	"github.com/google/cel-go/common/decls"
-	"github.com/google/cel-go/common/types"
-	"github.com/google/cel-go/ext"
-	"github.com/mailgun/raymond/v2/ast"
-	"github.com/mailgun/raymond/v2/parser"
-	"gopkg.in/yaml.v3"
-
 	"github.com/elastic/celfmt"
+	"github.com/elastic/celfmt/profiles"
 )
 
 func main() {
 	os.Exit(Main())
 }
 
+// Exit statuses returned by Main. Invalid flags result in an exit status
+// of 2 from the flag package.
+const (
+	exitOK          = 0
+	exitError       = 1 // invalid usage, or an input could not be formatted
+	exitUnformatted = 3 // an input needs formatting in -l or -d mode
+)
+
 // Main is the entry point for the celfmt command. It formats a CEL program
-// in a canonical format. It returns 0 on success and 1 on failure.
+// in a canonical format. It returns 0 on success and 1 on failure. When
+// listing or diffing with -l or -d, or reporting with -format=json or
+// -format=sarif, it returns 3 if any input needs to be formatted and no
+// input failed.
+//
+// If no file arguments are given, a single input is read from the -i file
+// or stdin and written to the -o file or stdout. Otherwise each file argument
+// is formatted, with directory arguments walked recursively for .cel and
+// .yml.hbs files, and the results written to stdout or, with -w, back to
+// the files.
 func Main() int {
 	in := flag.String("i", "", "input file stdin if empty")
 	out := flag.String("o", "", "output file stdout if empty")
 	agent := flag.Bool("agent", false, "format agent config (incompatible with extract)")
-	extract := flag.Bool("extract", false, "extract a formatted CEL program from an agent config (incompatible with agent)")
-	simplify := flag.Bool("s", false, "simplify expressions")
+	extract := flag.Bool("extract", false, "extract the formatted CEL programs from an agent config, separated by // --- lines (incompatible with agent)")
+	flag.Bool("s", false, "simplify expressions")
+	flag.Bool("check", false, "type-check programs against the environment before formatting")
+	flag.String("env", "", "environment profile for type-checking: "+strings.Join(profiles.Names(), ", ")+" (default mito)")
+	flag.String("decls", "", "YAML or JSON file declaring the variables and mito libraries of the environment")
+	flag.String("keys", "program", "comma-separated list of field names or dotted YAML paths holding CEL programs in agent configs")
+	write := flag.Bool("w", false, "write results to the file arguments instead of stdout")
+	list := flag.Bool("l", false, "list inputs whose formatting differs from celfmt's")
+	diff := flag.Bool("d", false, "print diffs for inputs whose formatting differs from celfmt's")
+	configFile := flag.String("config", "", "YAML file holding formatting settings instead of the nearest "+configName+"; flags override its settings")
+	printCfg := flag.Bool("print-config", false, "print the effective settings for each input instead of formatting")
+	flag.String("indent", "", "indent string, with Go escapes interpreted (default tab, or two spaces in agent mode)")
+	flag.Int("wrap-column", 80, "column beyond which to wrap lines on operators")
+	flag.String("wrap-operators", "&&,||", "comma-separated list of binary operators to wrap lines on")
+	flag.Bool("wrap-after", true, "place wrapped operators at the end of the line rather than the start of the next")
+	flag.String("layout", "source", "line breaking: source to break expressions that span lines in the source, width to also break expressions that extend beyond the wrap column, or canonical to break expressions only by width")
+	flag.Bool("trailing-comma", true, "add a trailing comma to multi-line lists, maps and messages")
+	flag.Bool("strict-comments", false, "fail rather than warn when a comment cannot be placed in the formatted program")
+	flag.Bool("align-comments", true, "align the trailing comments of consecutive lines")
+	reportFormat := flag.String("format", textFormat, "report format: text, json or sarif; json and sarif report the status of each input instead of printing the formatted results")
 	flag.Parse()
 
-	if *agent && *extract {
+	if *agent && *extract || *extract && (*list || *diff) {
 		flag.Usage()
-		return 1
+		return exitError
+	}
+	switch *reportFormat {
+	case textFormat:
+	case jsonFormat, sarifFormat:
+		if *list || *diff || *extract || *printCfg || *out != "" {
+			flag.Usage()
+			return exitError
+		}
+	default:
+		log.Printf("unknown report format: %s", *reportFormat)
+		return exitError
+	}
+	m := celMode
+	switch {
+	case *agent:
+		m = agentMode
+	case *extract:
+		m = extractMode
+	}
+	var cfgs configs
+	if *configFile != "" {
+		var err error
+		cfgs.file, err = loadConfig(*configFile)
+		if err != nil {
+			log.Print(err)
+			return exitError
+		}
+	}
+	cfgs.flags = &config{}
+	err := cfgs.flags.setFlags(flag.CommandLine)
+	if err != nil {
+		log.Print(err)
+		return exitError
+	}
+	dst := output{write: *write, list: *list, diff: *diff, format: *reportFormat}
+
+	if flag.NArg() != 0 {
+		if *in != "" || *out != "" || (*write && *extract) {
+			flag.Usage()
+			return exitError
+		}
+		files, err := collectFiles(flag.Args(), m)
+		if err != nil {
+			log.Print(err)
+			return exitError
+		}
+		for i, f := range files {
+			files[i].cfg, err = cfgs.forPath(f.path)
+			if err != nil {
+				log.Print(err)
+				return exitError
+			}
+			if *printCfg {
+				err = printConfig(os.Stdout, f.path, f.mode, files[i].cfg)
+				if err != nil {
+					log.Printf("could not write output: %v", err)
+					return exitError
+				}
+			}
+		}
+		if *printCfg {
+			return exitOK
+		}
+		return formatFiles(os.Stdout, files, dst)
+	}
+	if *write {
+		flag.Usage()
+		return exitError
+	}
+
+	name := *in
+	if name == "" {
+		name = "<standard input>"
+	}
+	cfg, err := cfgs.forPath(*in)
+	if err != nil {
+		log.Print(err)
+		return exitError
+	}
+	if *printCfg {
+		err = printConfig(os.Stdout, name, m, cfg)
+		if err != nil {
+			log.Printf("could not write output: %v", err)
+			return exitError
+		}
+		return exitOK
 	}
 
 	var r io.Reader
@@ -66,17 +176,17 @@ func Main() int {
 	} else {
 		f, err := os.Open(*in)
 		if err != nil {
-			log.Printf("could not open input file: %v", err)
-			return 1
+			log.Print(fileError(*in, ioError(err)))
+			return exitError
 		}
 		defer f.Close()
 		r = f
 	}
 	var buf bytes.Buffer
-	_, err := io.Copy(&buf, r)
+	_, err = io.Copy(&buf, r)
 	if err != nil {
-		log.Printf("could not read input: %v", err)
-		return 1
+		log.Print(fileError(name, ioError(err)))
+		return exitError
 	}
 
 	var w io.Writer
@@ -85,8 +195,8 @@ func Main() int {
 	} else {
 		f, err := os.Create(*out)
 		if err != nil {
-			log.Printf("could not open output file: %v", err)
-			return 1
+			log.Print(fileError(*out, ioError(err)))
+			return exitError
 		}
 		defer func() {
 			f.Sync()
@@ -95,234 +205,117 @@ func Main() int {
 		w = f
 	}
 
-	if *agent || *extract {
-		ast, err := parser.Parse(buf.String())
-		if err != nil {
-			panic(err)
-		}
-		var indent string
-		if *agent {
-			indent = "  "
-		}
-		v := &visitor{indent: indent, simplify: *simplify, extract: *extract}
-		ast.Accept(v)
-		if v.err != nil {
-			log.Fatal(v.err)
-		}
-		if *agent {
-			fmt.Fprint(w, strings.ReplaceAll(buf.String(), v.old, v.new))
-		} else {
-			fmt.Fprint(w, v.new)
-		}
-	} else {
-		err = celFmt(w, buf.String(), "", *simplify)
-		if err != nil {
-			log.Printf("failed to format program: %v", err)
-			return 1
-		}
-		fmt.Fprintln(w)
+	res := format(buf.String(), m, cfg)
+	if dst.format != textFormat {
+		return dst.writeReport(w, []string{name}, []result{res})
 	}
-
-	return 0
-}
-
-type visitor struct {
-	old      string
-	new      string
-	indent   string
-	simplify bool
-	extract  bool
-	err      error
-}
-
-func (v *visitor) VisitProgram(node *ast.Program) any {
-	for _, n := range node.Body {
-		n.Accept(v)
+	for _, w := range res.warnings {
+		log.Printf("warning: %v", w)
 	}
-	return nil
-}
-
-func (v *visitor) VisitContent(s *ast.ContentStatement) any {
-	prefix, program, suffix, err := findProgramYAML(s.Value)
-	if err != nil {
-		v.err = err
-		return nil
+	if res.err != nil {
+		log.Print(fileError(name, res.err))
+		return exitError
 	}
-	if program != "" {
-		program, err = celFmtYAML(program, v.indent, v.simplify, v.extract)
-		if err != nil {
-			if errors.As(err, &warn{}) {
-				log.Printf("did not format program field content at line %d: %s", s.Line, err)
-			}
-			v.err = err
-			return nil
-		}
-		v.old = s.Value
-		if v.extract {
-			v.new = program + "\n"
-		} else {
-			v.new = prefix + program + suffix
-		}
+	status, err := dst.report(w, name, res.src, res.formatted)
+	if err != nil {
+		log.Printf("could not write output: %v", err)
+		return exitError
 	}
-	return nil
+	return status
 }
 
-func (v *visitor) VisitBlock(s *ast.BlockStatement) any {
-	p, ok := s.Expression.Path.(*ast.PathExpression)
-	if !ok || p.Original != "if" {
-		return nil
-	}
-	if s.Program != nil {
-		for _, n := range s.Program.Body {
-			n.Accept(v)
-		}
-	}
-	if s.Inverse != nil {
-		for _, n := range s.Inverse.Body {
-			n.Accept(v)
-		}
-	}
-	return nil
-}
+// programSeparator is the line written between the programs extracted from
+// an agent configuration that holds more than one.
+const programSeparator = "// ---"
 
-func celFmtYAML(src, indent string, simplify, extract bool) (string, error) {
-	var n yaml.Node
-	err := yaml.Unmarshal([]byte(src), &n)
-	if err != nil {
-		return "", err
-	}
-	if len(n.Content) != 1 && len(n.Content[0].Content) != 2 {
-		return "", fmt.Errorf("unexpected shape")
-	}
+// mode is the formatting mode for an input.
+type mode int
 
-	var buf strings.Builder
-	err = celFmt(&buf, n.Content[0].Content[1].Value, indent, simplify)
-	if err != nil {
-		return "", warn{err}
-	}
-	if extract {
-		return buf.String(), nil
-	}
-	// We should be able to do this properly, but there is no
-	// non-buggy YAML library that will not double-quote some
-	// programs.
-	return "program: |-\n  " + strings.ReplaceAll(buf.String(), "\n", "\n  ") + "\n", nil
-}
+const (
+	celMode     mode = iota // a CEL program
+	agentMode               // an agent configuration template
+	extractMode             // extract programs from an agent configuration template
+)
 
-type warn struct{ error }
+// format returns the result of formatting src according to the mode and
+// configuration.
+func format(src string, m mode, cfg *config) result {
+	r := result{src: src}
+	if m == celMode {
+		var buf strings.Builder
+		var rep celfmt.Report
+		rep, r.err = celFmt(&buf, src, cfg, m)
+		if r.err != nil {
+			return r
+		}
+		r.simplifications = rep.Simplifications
+		for _, c := range rep.DroppedComments {
+			r.warnings = append(r.warnings, droppedComment(c))
+		}
+		buf.WriteByte('\n')
+		r.formatted = buf.String()
+		return r
+	}
 
-func celFmt(dst io.Writer, src, indent string, simplify bool) error {
-	xmlHelper, err := lib.XML(nil, nil)
-	if err != nil {
-		return fmt.Errorf("failed to initialize xml helper: %w", err)
+	// Templates with CRLF line endings are handled with LF line endings,
+	// which are restored when the template is rewritten.
+	crlf := strings.Contains(src, "\r\n")
+	if crlf {
+		src = strings.ReplaceAll(src, "\r\n", "\n")
 	}
-	env, err := cel.NewEnv(
-		cel.VariableDecls(
-			decls.NewVariable("state", types.DynType),
-			decls.NewVariable("useragent", types.StringType),
-		),
-		lib.Collections(),
-		lib.Crypto(),
-		lib.JSON(nil),
-		lib.Time(),
-		lib.Try(),
-		lib.Debug(func(_ string, _ any) {}),
-		lib.File(nil),
-		lib.MIME(nil),
-		lib.HTTP(nil, nil, nil),
-		lib.Limit(nil),
-		lib.Regexp(nil),
-		lib.Strings(),
-		lib.Printf(),
-		xmlHelper,
-		cel.OptionalTypes(cel.OptionalTypesVersion(lib.OptionalTypesVersion)),
-		ext.TwoVarComprehensions(ext.TwoVarComprehensionsVersion(lib.OptionalTypesVersion)),
-		cel.EnableMacroCallTracking(),
-	)
+	ast, err := parseTemplate(src)
 	if err != nil {
-		return fmt.Errorf("failed to create env: %w", err)
-	}
-	compiled, iss := env.Compile(src)
-	if iss != nil {
-		return fmt.Errorf("failed to parse program: %v", iss)
+		r.err = err
+		return r
 	}
-	textSrc := common.NewTextSource(src)
-	if simplify {
-		celfmt.Simplify(compiled.NativeRep(), textSrc)
+	v := &visitor{
+		src:     src,
+		keys:    cfg.keys(),
+		cfg:     cfg,
+		mode:    m,
+		extract: m == extractMode,
 	}
-	opts := []celfmt.FormatOption{
-		celfmt.Pretty(),
-		celfmt.AlwaysComma(),
+	ast.Accept(v)
+	r.warnings = v.warnings
+	r.simplifications = v.simplifications
+	if v.err != nil {
+		r.err = v.err
+		return r
 	}
-	if indent != "" {
-		opts = append(opts, celfmt.IndentString(indent))
-	}
-	return celfmt.Format(dst, compiled.NativeRep(), textSrc, opts...)
-}
-
-func findProgramYAML(s string) (prefix, program, suffix string, err error) {
-	var yn yaml.Node
-	idx := strings.Index(s, "\nprogram: |")
-	if idx < 0 {
-		if !strings.HasPrefix(s, "program: |") {
-			return prefix, program, suffix, err
+	if m == agentMode {
+		r.formatted = applyEdits(src, v.edits)
+		if crlf {
+			r.formatted = strings.ReplaceAll(r.formatted, "\n", "\r\n")
 		}
-		// idx is -1 so the inc that follows
-		// brings us to the start of the string.
-	}
-	idx++
-	prefix = s[:idx]
-	program = s[idx:]
-	err = yaml.Unmarshal([]byte(program), &yn)
-	if err != nil {
-		return "", "", "", err
+		return r
 	}
-	next := findNext(&yn, "program")
-	if next == nil {
-		return prefix, program, "", nil
-	}
-	suffix = s[idx:]
-	for l := 1; l < next.Line; l++ {
-		var ok bool
-		_, suffix, ok = strings.Cut(suffix, "\n")
-		if !ok {
-			break
+	// Each extracted program is a separate CEL program, so the
+	// programs are separated by a line holding programSeparator.
+	var buf strings.Builder
+	for i, e := range v.edits {
+		if i != 0 {
+			buf.WriteString(programSeparator + "\n")
 		}
+		buf.WriteString(e.text)
 	}
-	program = strings.TrimSuffix(program, suffix)
-	return prefix, program, suffix, nil
+	r.formatted = buf.String()
+	return r
 }
 
-func findNext(node *yaml.Node, tag string) *yaml.Node {
-	var keyOK, valOK bool
-	for _, n := range node.Content {
-		c := findNext(n, tag)
-		if c != nil {
-			return c
-		}
-		if valOK {
-			return n
-		}
-		if keyOK {
-			valOK = true
-			continue
-		}
-		if n.Value == tag {
-			keyOK = true
-		}
+// celFmt formats the CEL program in src according to cfg in the mode m,
+// writing the result to dst and returning the report of the changes made.
+// The program is only type-checked if cfg requires it. Any vars are declared
+// as dynamically typed variables in addition to the declared variables and
+// those in cfg.
+func celFmt(dst io.Writer, src string, cfg *config, m mode, vars ...string) (celfmt.Report, error) {
+	f, err := cfg.formatter(m, vars)
+	if err != nil {
+		return celfmt.Report{}, err
 	}
-	return nil
+	formatted, rep, err := f.FormatReport(src)
+	if err != nil {
+		return rep, err
+	}
+	_, err = io.WriteString(dst, formatted)
+	return rep, err
 }
-
-// ¯\_(ツ)_/¯
-func (v *visitor) VisitMustache(*ast.MustacheStatement) any  { return nil }
-func (v *visitor) VisitPartial(*ast.PartialStatement) any    { return nil }
-func (v *visitor) VisitComment(*ast.CommentStatement) any    { return nil }
-func (v *visitor) VisitExpression(*ast.Expression) any       { return nil }
-func (v *visitor) VisitSubExpression(*ast.SubExpression) any { return nil }
-func (v *visitor) VisitPath(*ast.PathExpression) any         { return nil }
-func (v *visitor) VisitString(*ast.StringLiteral) any        { return nil }
-func (v *visitor) VisitBoolean(*ast.BooleanLiteral) any      { return nil }
-func (v *visitor) VisitNumber(*ast.NumberLiteral) any        { return nil }
-func (v *visitor) VisitHash(*ast.Hash) any                   { return nil }
-func (v *visitor) VisitHashPair(*ast.HashPair) any           { return nil }
@@ -18,8 +18,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/rogpeppe/go-internal/testscript"
@@ -39,6 +42,70 @@ func TestScripts(t *testing.T) {
 	p := testscript.Params{
 		Dir:           filepath.Join("testdata"),
 		UpdateScripts: *update,
+		Cmds: map[string]func(*testscript.TestScript, bool, []string){
+			"status": status,
+		},
 	}
 	testscript.Run(t, p)
 }
+
+// status runs a program and checks its exit status.
+//
+//	status code program [args...]
+func status(ts *testscript.TestScript, neg bool, args []string) {
+	if neg {
+		ts.Fatalf("unsupported: ! status")
+	}
+	if len(args) < 2 {
+		ts.Fatalf("usage: status code program [args...]")
+	}
+	want, err := strconv.Atoi(args[0])
+	ts.Check(err)
+	var got int
+	err = ts.Exec(args[1], args[2:]...)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			ts.Fatalf("%v", err)
+		}
+		got = exitErr.ExitCode()
+	}
+	if got != want {
+		ts.Fatalf("unexpected exit status: got %d, want %d", got, want)
+	}
+}
+
+func TestSharedFormatters(t *testing.T) {
+	dir := t.TempDir()
+	c := &configs{flags: &config{}}
+	a, err := c.forPath(filepath.Join(dir, "a.cel"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := c.forPath(filepath.Join(dir, "b.cel"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a != b {
+		t.Fatal("inputs with the same configuration do not share it")
+	}
+
+	f1, err := a.formatter(agentMode, []string{"x", "y"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f2, err := b.formatter(agentMode, []string{"y", "x"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f1 != f2 {
+		t.Error("formatter for the same variables was rebuilt")
+	}
+	f3, err := b.formatter(agentMode, []string{"x"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f1 == f3 {
+		t.Error("formatter for different variables was shared")
+	}
+}
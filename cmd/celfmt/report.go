@@ -0,0 +1,285 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"path/filepath"
+
+	"github.com/elastic/celfmt"
+)
+
+// Report formats selected by the -format flag.
+const (
+	textFormat  = "text"  // formatted results, or lists and diffs, with failures logged
+	jsonFormat  = "json"  // a JSON record for each input, one per line
+	sarifFormat = "sarif" // a SARIF 2.1.0 log
+)
+
+// Statuses of an input in a report.
+const (
+	statusFormatted = "formatted" // the input's formatting differs from celfmt's
+	statusUnchanged = "unchanged" // the input is already formatted
+	statusError     = "error"     // the input could not be formatted
+)
+
+// record is the report for a single input.
+type record struct {
+	File            string           `json:"file"`
+	Status          string           `json:"status"`
+	Errors          []errorRecord    `json:"errors,omitempty"`
+	Warnings        []warningRecord  `json:"warnings,omitempty"`
+	Simplifications []simplifyRecord `json:"simplifications,omitempty"`
+}
+
+// errorRecord is an error in a record. Kind is empty for errors that are
+// not associated with a program, and Line and Column are zero when the
+// position is not known.
+type errorRecord struct {
+	Kind    string `json:"kind,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type warningRecord struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type simplifyRecord struct {
+	Rule   string `json:"rule"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// newRecord returns the record for the result r of formatting the input
+// name.
+func newRecord(name string, r result) record {
+	rec := record{File: name, Status: statusUnchanged}
+	switch {
+	case r.err != nil:
+		rec.Status = statusError
+		rec.Errors = errorRecords(r.err)
+	case r.formatted != r.src:
+		rec.Status = statusFormatted
+	}
+	for _, w := range r.warnings {
+		rec.Warnings = append(rec.Warnings, warningRecord{Line: w.line, Column: w.col, Message: w.msg})
+	}
+	if r.err == nil {
+		for _, s := range r.simplifications {
+			rec.Simplifications = append(rec.Simplifications, simplifyRecord(s))
+		}
+	}
+	return rec
+}
+
+// errorRecords returns a record for each error held by err.
+func errorRecords(err error) []errorRecord {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *celfmt.Error:
+		return []errorRecord{{
+			Kind:    e.Kind.String(),
+			Line:    e.Line,
+			Column:  e.Column,
+			Message: e.Err.Error(),
+		}}
+	case interface{ Unwrap() []error }:
+		var recs []errorRecord
+		for _, e := range e.Unwrap() {
+			recs = append(recs, errorRecords(e)...)
+		}
+		return recs
+	default:
+		return []errorRecord{{Message: err.Error()}}
+	}
+}
+
+// writeReport writes a report of the results of formatting the named inputs
+// to dst in the output's format, returning the command's exit status.
+func (o output) writeReport(dst io.Writer, names []string, results []result) int {
+	status := exitOK
+	recs := make([]record, len(results))
+	for i, r := range results {
+		recs[i] = newRecord(names[i], r)
+		switch {
+		case recs[i].Status == statusError:
+			status = exitError
+		case recs[i].Status == statusFormatted && !o.write && status == exitOK:
+			status = exitUnformatted
+		}
+	}
+	var err error
+	switch o.format {
+	case jsonFormat:
+		enc := json.NewEncoder(dst)
+		enc.SetEscapeHTML(false)
+		for _, rec := range recs {
+			err = enc.Encode(rec)
+			if err != nil {
+				break
+			}
+		}
+	case sarifFormat:
+		enc := json.NewEncoder(dst)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(newSARIF(recs, o.write))
+	}
+	if err != nil {
+		log.Printf("could not write output: %v", err)
+		return exitError
+	}
+	return status
+}
+
+// SARIF 2.1.0 log, holding only the properties used by celfmt. See
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html.
+type (
+	sarifLog struct {
+		Version string     `json:"version"`
+		Schema  string     `json:"$schema"`
+		Runs    []sarifRun `json:"runs"`
+	}
+	sarifRun struct {
+		Tool       sarifTool       `json:"tool"`
+		ColumnKind string          `json:"columnKind"`
+		Artifacts  []sarifArtifact `json:"artifacts"`
+		Results    []sarifResult   `json:"results"`
+	}
+	sarifTool struct {
+		Driver sarifDriver `json:"driver"`
+	}
+	sarifDriver struct {
+		Name           string      `json:"name"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	}
+	sarifRule struct {
+		ID               string       `json:"id"`
+		ShortDescription sarifMessage `json:"shortDescription"`
+	}
+	sarifArtifact struct {
+		Location sarifArtifactLocation `json:"location"`
+	}
+	sarifResult struct {
+		RuleID    string          `json:"ruleId"`
+		Level     string          `json:"level"`
+		Message   sarifMessage    `json:"message"`
+		Locations []sarifLocation `json:"locations"`
+	}
+	sarifMessage struct {
+		Text string `json:"text"`
+	}
+	sarifLocation struct {
+		PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	}
+	sarifPhysicalLocation struct {
+		ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+		Region           *sarifRegion          `json:"region,omitempty"`
+	}
+	sarifArtifactLocation struct {
+		URI   string `json:"uri"`
+		Index int    `json:"index"`
+	}
+	sarifRegion struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn,omitempty"`
+	}
+)
+
+// sarifRules are the rules of the results in a SARIF log. Errors are
+// identified by their kind, except for I/O errors since a slash separates
+// the components of hierarchical rule IDs.
+var sarifRules = []sarifRule{
+	{ID: "unformatted", ShortDescription: sarifMessage{"The input's formatting differs from celfmt's."}},
+	{ID: celfmt.ParseError.String(), ShortDescription: sarifMessage{"The program could not be parsed."}},
+	{ID: celfmt.CheckError.String(), ShortDescription: sarifMessage{"The program failed type-checking."}},
+	{ID: celfmt.UnsupportedError.String(), ShortDescription: sarifMessage{"The program holds a construct that cannot be formatted."}},
+	{ID: "io", ShortDescription: sarifMessage{"The input could not be read or written."}},
+	{ID: celfmt.TemplateError.String(), ShortDescription: sarifMessage{"The agent configuration template could not be parsed."}},
+	{ID: celfmt.CommentError.String(), ShortDescription: sarifMessage{"A comment could not be placed in the formatted program."}},
+	{ID: "error", ShortDescription: sarifMessage{"The input could not be formatted."}},
+	{ID: "warning", ShortDescription: sarifMessage{"Part of the input could not be formatted."}},
+	{ID: celfmt.RuleInlineAs, ShortDescription: sarifMessage{"A single-use .as() binding was inlined."}},
+	{ID: celfmt.RuleBoolCmp, ShortDescription: sarifMessage{"A comparison with a boolean literal was eliminated."}},
+	{ID: celfmt.RuleHasTernary, ShortDescription: sarifMessage{"A has() ternary was rewritten to an optional field selection."}},
+}
+
+// newSARIF returns a SARIF log holding the records. Inputs that need
+// formatting are only reported as unformatted if they were not written.
+func newSARIF(recs []record, written bool) sarifLog {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "celfmt",
+			InformationURI: "https://github.com/elastic/celfmt",
+			Rules:          sarifRules,
+		}},
+		ColumnKind: "unicodeCodePoints",
+		Artifacts:  make([]sarifArtifact, len(recs)),
+		Results:    []sarifResult{},
+	}
+	for i, rec := range recs {
+		loc := sarifArtifactLocation{URI: filepath.ToSlash(rec.File), Index: i}
+		run.Artifacts[i] = sarifArtifact{Location: loc}
+		add := func(rule, level, msg string, line, col int) {
+			l := sarifLocation{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: loc}}
+			if line > 0 {
+				l.PhysicalLocation.Region = &sarifRegion{StartLine: line, StartColumn: col}
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    rule,
+				Level:     level,
+				Message:   sarifMessage{msg},
+				Locations: []sarifLocation{l},
+			})
+		}
+		if rec.Status == statusFormatted && !written {
+			add("unformatted", "warning", "file is not formatted", 1, 0)
+		}
+		for _, e := range rec.Errors {
+			var rule string
+			switch e.Kind {
+			case "":
+				rule = "error"
+			case celfmt.IOError.String():
+				rule = "io"
+			default:
+				rule = e.Kind
+			}
+			add(rule, "error", e.Message, e.Line, e.Column)
+		}
+		for _, w := range rec.Warnings {
+			add("warning", "warning", w.Message, w.Line, w.Column)
+		}
+		for _, s := range rec.Simplifications {
+			add(s.Rule, "note", "simplified expression ("+s.Rule+")", s.Line, s.Column)
+		}
+	}
+	return sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	}
+}
@@ -24,9 +24,11 @@
 // # celFmt
 //
 // The celFmt function formats a given CEL program to canonical format.
-// It requires one argument, which must be a string. The function returns an
-// object with either a 'formatted' attribute containing the formatted CEL
-// program or an 'error' attribute containing the error message.
+// It requires one argument, which must be a string, and accepts an optional
+// second string argument holding YAML or JSON declarations of the program's
+// environment. The function returns an object with either a 'formatted'
+// attribute containing the formatted CEL program or an 'error' attribute
+// containing the error message.
 //
 // # celModuleBuildMetadata
 //
@@ -35,88 +37,62 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
 	"runtime"
 	"runtime/debug"
 	"strings"
 	"syscall/js"
 
-	"github.com/elastic/mito/lib"
-	"github.com/google/cel-go/cel"
-	"github.com/google/cel-go/common"
-	"github.com/google/cel-go/common/decls"
-	"github.com/google/cel-go/common/types"
-	"github.com/google/cel-go/ext"
-
 	"github.com/elastic/celfmt"
+	"github.com/elastic/celfmt/mitoenv"
 )
 
 //go:generate install -m 0744 "$GOROOT/lib/wasm/wasm_exec.js" "$PWD/assets"
 
-func compileAndFormat(dst io.Writer, src string) error {
-	xmlHelper, err := lib.XML(nil, nil)
-	if err != nil {
-		return fmt.Errorf("failed to initialize xml helper: %w", err)
-	}
-	env, err := cel.NewEnv(
-		cel.VariableDecls(decls.NewVariable("state", types.DynType)),
-		lib.Collections(),
-		lib.Crypto(),
-		lib.JSON(nil),
-		lib.Time(),
-		lib.Try(),
-		lib.Debug(func(_ string, _ any) {}),
-		lib.File(nil),
-		lib.MIME(nil),
-		lib.HTTP(nil, nil, nil),
-		lib.Limit(nil),
-		lib.Regexp(nil),
-		lib.Strings(),
-		lib.Printf(),
-		xmlHelper,
-		cel.OptionalTypes(cel.OptionalTypesVersion(lib.OptionalTypesVersion)),
-		ext.TwoVarComprehensions(ext.TwoVarComprehensionsVersion(lib.OptionalTypesVersion)),
-		cel.EnableMacroCallTracking(),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to create env: %w", err)
-	}
-	ast, iss := env.Compile(src)
-	if iss != nil {
-		return fmt.Errorf("failed to parse program: %v", iss)
-	}
-	return celfmt.Format(dst, ast.NativeRep(), common.NewTextSource(src), celfmt.Pretty(), celfmt.AlwaysComma())
-}
-
 type celFmtResult struct {
 	Error     string `json:"error,omitempty"`
 	Formatted string `json:"formatted,omitempty"`
 }
 
 // celFmt formats a given string using our CEL (Common Expression Language)
-// formatting rules. It compiles the given program as part of the formatting
-// process. This function takes one argument, which must be a string.
+// formatting rules. This function takes one argument, which must be a string,
+// and an optional second string argument holding the declarations of the
+// program's environment as accepted by celfmt.ParseDeclarations. Without
+// declarations the celfmt.DefaultDeclarations are used. As with the celfmt
+// command, the program only needs to parse unless the declarations require
+// it to type-check.
 //
 // The function always returns an object. On success, the object contains one
 // attribute named 'formatted' which contains the formatted CEL program. If any
 // error occurs, then the object contains an attribute named 'error' whose value
 // is the string error message.
 func celFmt(_ js.Value, args []js.Value) any {
-	if len(args) != 1 {
-		return toObject(&celFmtResult{Error: "celFmt requires one argument"})
+	if len(args) != 1 && len(args) != 2 {
+		return toObject(&celFmtResult{Error: "celFmt requires one or two arguments"})
 	}
 	if args[0].Type() != js.TypeString {
 		return toObject(&celFmtResult{Error: "celFmt argument must be a string"})
 	}
+	decls := celfmt.DefaultDeclarations()
+	if len(args) == 2 {
+		if args[1].Type() != js.TypeString {
+			return toObject(&celFmtResult{Error: "celFmt declarations argument must be a string"})
+		}
+		var err error
+		decls, err = celfmt.ParseDeclarations([]byte(args[1].String()))
+		if err != nil {
+			return toObject(&celFmtResult{Error: err.Error()})
+		}
+	}
 
-	buf := new(bytes.Buffer)
-	if err := compileAndFormat(buf, args[0].String()); err != nil {
+	formatted, err := celfmt.FormatSource(args[0].String(), celfmt.Options{
+		Declarations: decls,
+		Format:       []celfmt.FormatOption{celfmt.Pretty(), celfmt.AlwaysComma()},
+	})
+	if err != nil {
 		return toObject(&celFmtResult{Error: err.Error()})
 	}
-	return toObject(&celFmtResult{Formatted: buf.String()})
+	return toObject(&celFmtResult{Formatted: formatted})
 }
 
 // toObject converts a struct to a map[string]any using JSON marshal/unmarshal.
@@ -144,6 +120,7 @@ func toObject(v any) map[string]any {
 //   - celfmt: The version of the main module in the build information.
 //   - mito: The version of the "github.com/elastic/mito" module.
 //   - cel-go: The version of the "github.com/google/cel-go" module.
+//   - libraries: The mito extension libraries available to programs.
 //   - commit: The VCS revision (commit hash) from the build settings, if available.
 //   - commit_time: The timestamp of the VCS revision from the build settings, if available.
 func moduleBuildMetadata(_ js.Value, _ []js.Value) any {
@@ -156,6 +133,12 @@ func moduleBuildMetadata(_ js.Value, _ []js.Value) any {
 		"go":     strings.TrimPrefix(runtime.Version(), "go"),
 		"celfmt": info.Main.Version,
 	}
+	// js.ValueOf only converts []any slices.
+	var libs []any
+	for _, l := range mitoenv.LibraryNames() {
+		libs = append(libs, l)
+	}
+	meta["libraries"] = libs
 
 	for _, m := range info.Deps {
 		switch m.Path {
@@ -0,0 +1,328 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+)
+
+// Comment is a comment in the source of a program.
+type Comment struct {
+	// Text is the comment including its "//". In the leading
+	// comments of an expression, a comment with empty text stands
+	// for a blank line.
+	Text string
+
+	// Line and Column are the 1-based position of the comment's
+	// "//" in the source, or zero for comments that are not from
+	// the source. Columns count runes.
+	Line, Column int
+}
+
+// CommentKind is the relationship of a comment to its expression.
+type CommentKind int
+
+const (
+	LeadingComment  CommentKind = iota + 1 // on the lines before the expression
+	TrailingComment                        // at the end of the line on which the expression ends
+	DanglingComment                        // within or after the expression but not placed relative to it
+)
+
+// ExprComments holds the comments attached to an expression.
+type ExprComments struct {
+	Leading  []Comment
+	Trailing []Comment
+	Dangling []Comment
+}
+
+// CommentMap associates comments with the IDs of the expressions they are
+// attached to. A CommentMap may be adjusted when an AST is rewritten so
+// that comments follow the expressions they describe, and passed to Format
+// with the Comments option.
+type CommentMap map[int64]ExprComments
+
+// NewCommentMap returns the comments in src associated with expressions in
+// the AST a as Format attaches them. Comments that Format would not place
+// are dangling comments of the expression that precedes them, and those
+// following the program are dangling comments of the root expression.
+func NewCommentMap(a *ast.AST, src common.Source) CommentMap {
+	opts, _ := applyOptions([]FormatOption{Pretty()})
+	un := newFormatter(io.Discard, a, src, opts)
+	un.record = make(CommentMap)
+	// Attachment does not depend on whether the expression could be
+	// formatted, and comments that were not reached are recovered
+	// below.
+	_ = un.visit(a.Expr(), false)
+	un.writeTrailingComments()
+	for _, d := range un.droppedComments() {
+		un.recordComments(precedingExpr(a, src, d), DanglingComment, Comment(d))
+	}
+	return un.record
+}
+
+// precedingExpr returns the ID of the expression in a that ends closest
+// before the comment c, or the root expression if there is none.
+func precedingExpr(a *ast.AST, src common.Source, c DroppedComment) int64 {
+	id := a.Expr().ID()
+	offset, ok := src.LocationOffset(common.NewLocation(c.Line, c.Column-1))
+	if !ok {
+		return id
+	}
+	stop := int32(-1)
+	for eid, r := range a.SourceInfo().OffsetRanges() {
+		if r.Stop > offset || r.Stop < stop {
+			continue
+		}
+		// Prefer the lowest ID among expressions ending at the
+		// same offset for determinism.
+		if r.Stop > stop || eid < id {
+			id, stop = eid, r.Stop
+		}
+	}
+	return id
+}
+
+// Update moves the comments of the expression with the ID old to the
+// expression with the ID new, after any comments new already has. It is
+// used when a rewrite replaces an expression.
+func (m CommentMap) Update(old, new int64) {
+	if old == new {
+		return
+	}
+	o, ok := m[old]
+	if !ok {
+		return
+	}
+	n := m[new]
+	n.Leading = append(n.Leading, o.Leading...)
+	n.Trailing = append(n.Trailing, o.Trailing...)
+	n.Dangling = append(n.Dangling, o.Dangling...)
+	m[new] = n
+	delete(m, old)
+}
+
+// Comments returns all the comments in m, other than blank lines, ordered
+// by their position in the source. Comments that are not from the source
+// are last.
+func (m CommentMap) Comments() []Comment {
+	var all []Comment
+	for _, ec := range m {
+		for _, list := range [][]Comment{ec.Leading, ec.Trailing, ec.Dangling} {
+			for _, c := range list {
+				if c.Text != "" {
+					all = append(all, c)
+				}
+			}
+		}
+	}
+	slices.SortStableFunc(all, compareComments)
+	return all
+}
+
+// compareComments orders comments by position, with comments that are not
+// from the source last.
+func compareComments(a, b Comment) int {
+	if (a.Line == 0) != (b.Line == 0) {
+		if a.Line == 0 {
+			return 1
+		}
+		return -1
+	}
+	return cmp.Or(cmp.Compare(a.Line, b.Line), cmp.Compare(a.Column, b.Column), strings.Compare(a.Text, b.Text))
+}
+
+// commentKey identifies the comments of a kind attached to an expression.
+type commentKey struct {
+	id   int64
+	kind CommentKind
+}
+
+// recordComments records the comments of the given kind for the expression
+// with the given ID if the formatter is recording comments.
+func (un *formatter) recordComments(id int64, kind CommentKind, comments ...Comment) {
+	if un.record == nil || len(comments) == 0 {
+		return
+	}
+	ec := un.record[id]
+	switch kind {
+	case LeadingComment:
+		ec.Leading = append(ec.Leading, comments...)
+	case TrailingComment:
+		ec.Trailing = append(ec.Trailing, comments...)
+	case DanglingComment:
+		ec.Dangling = append(ec.Dangling, comments...)
+	}
+	un.record[id] = ec
+}
+
+// comment returns c as a Comment.
+func (c sourceComment) comment() Comment {
+	return Comment{Text: strings.TrimSpace(c.text), Line: c.line, Column: c.runeCol + 1}
+}
+
+// commentLines returns the lines to write for the leading comments, with
+// blank lines as empty strings.
+func commentLines(comments []Comment) []string {
+	if len(comments) == 0 {
+		return nil
+	}
+	lines := make([]string, len(comments))
+	for i, c := range comments {
+		if c.Text != "" {
+			lines[i] = normalizeComment(c.Text)
+		}
+	}
+	return lines
+}
+
+// DroppedComment is a comment in the source that Format could not place
+// in the formatted text.
+type DroppedComment Comment
+
+// normalizeComment returns the comment text with a single space between
+// the comment mark and its text, and no trailing white space.
+func normalizeComment(comment string) string {
+	// Remove comment prefix and any leading non-tab spaces.
+	comment = strings.TrimPrefix(comment, "//")
+	idx := strings.IndexFunc(comment, func(r rune) bool {
+		return r == '\t' || !unicode.IsSpace(r)
+	})
+	if idx >= 0 {
+		comment = comment[idx:]
+	}
+	// Remove all trailing white space.
+	comment = strings.TrimRight(comment, " \t\n\v\f\r\u0085\u00a0")
+	// Format comment with a leading space between text and mark.
+	if comment == "" {
+		return "//"
+	}
+	return "// " + comment
+}
+
+// writeTrailingComments writes the comments that follow the last token of
+// the program, which have no expression to be attached to. A comment on
+// the same line as the last token remains on that line, and single blank
+// lines between comments are retained.
+func (un *formatter) writeTrailingComments() {
+	if un.cmap != nil {
+		key := commentKey{un.root, DanglingComment}
+		if !un.emitted[key] {
+			un.emitted[key] = true
+			un.writeCommentsAfter(un.cmap[un.root].Dangling)
+		}
+		return
+	}
+	var trailing []Comment
+	for _, c := range un.text.comments {
+		loc := location{c.line, c.col}
+		if c.offset < un.text.end {
+			continue
+		}
+		if _, ok := un.comments[loc]; ok {
+			continue
+		}
+		un.comments[loc] = un.root
+		trailing = append(trailing, c.comment())
+	}
+	un.recordComments(un.root, DanglingComment, trailing...)
+	un.writeCommentsAfter(trailing)
+}
+
+// writeCommentsAfter writes comments after the program.
+func (un *formatter) writeCommentsAfter(comments []Comment) {
+	prev := un.text.endLine
+	for _, c := range comments {
+		if c.Text == "" {
+			continue
+		}
+		text := normalizeComment(c.Text)
+		if c.Line == un.text.endLine {
+			un.add(docComment(" " + text))
+			continue
+		}
+		if c.Line > prev+1 {
+			un.WriteNewLine()
+			un.WriteString("")
+		}
+		un.WriteNewLine()
+		un.WriteString(text)
+		prev = max(c.Line, prev)
+	}
+}
+
+// droppedComments returns the comments that were not written, ordered by
+// position.
+func (un *formatter) droppedComments() []DroppedComment {
+	var dropped []DroppedComment
+	if un.cmap != nil {
+		for id, ec := range un.cmap {
+			for kind, list := range map[CommentKind][]Comment{
+				LeadingComment:  ec.Leading,
+				TrailingComment: ec.Trailing,
+				DanglingComment: ec.Dangling,
+			} {
+				if un.emitted[commentKey{id, kind}] {
+					continue
+				}
+				for _, c := range list {
+					if c.Text != "" {
+						dropped = append(dropped, DroppedComment(c))
+					}
+				}
+			}
+		}
+		slices.SortStableFunc(dropped, func(a, b DroppedComment) int {
+			return compareComments(Comment(a), Comment(b))
+		})
+		return dropped
+	}
+	for _, c := range un.text.comments {
+		if _, ok := un.comments[location{c.line, c.col}]; ok {
+			continue
+		}
+		dropped = append(dropped, DroppedComment(c.comment()))
+	}
+	return dropped
+}
+
+// droppedCommentsError returns a CommentError for each of the dropped
+// comments, joined if there is more than one.
+func droppedCommentsError(dropped []DroppedComment) error {
+	var errs []error
+	for _, c := range dropped {
+		errs = append(errs, &Error{
+			Kind:   CommentError,
+			Line:   c.Line,
+			Column: c.Column,
+			Err:    fmt.Errorf("comment could not be placed: %s", c.Text),
+		})
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,323 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/parser"
+)
+
+var droppedCommentsTests = []struct {
+	name        string
+	src         string
+	want        string
+	wantDropped []DroppedComment
+	wantErr     string
+}{
+	{
+		name: "placed",
+		src:  "[\n  // leading\n  1, // trailing\n]",
+		want: "[\n  // leading\n  1, // trailing\n]",
+	},
+	{
+		name: "end_of_program",
+		src:  "[\n  1,\n] // after\n\n\n// end\n//  more",
+		want: "[\n  1,\n] // after\n\n// end\n// more",
+	},
+	{
+		name: "string",
+		src:  `"http://example.com" + '//' // url`,
+		want: `"http://example.com" + "//" // url`,
+	},
+	{
+		name: "string_after_element",
+		src:  "[\n  1, \"a//b\",\n  2,\n]",
+		want: "[\n  1,\n  \"a//b\",\n  2,\n]",
+	},
+	{
+		name: "triple_quoted",
+		src:  "[\n  '''\n// text\n''', // comment\n]",
+		want: "[\n  '''\n// text\n''', // comment\n]",
+	},
+	{
+		// Single blank lines between elements are kept without a
+		// comment, and runs of blank lines are collapsed.
+		name: "blank_lines",
+		src:  "{\n  \"events\": e,\n\n\n  \"cursor\": c,\n  \"want_more\": [\n    1,\n\n    2,\n  ],\n}",
+		want: "{\n  \"events\": e,\n\n  \"cursor\": c,\n  \"want_more\": [\n    1,\n\n    2,\n  ],\n}",
+	},
+	{
+		name: "blank_line_field",
+		src:  "m.T{\n  a: 1,\n\n  b: 2,\n  // c\n  d: 3,\n}",
+		want: "m.T{\n  a: 1,\n\n  b: 2,\n  // c\n  d: 3,\n}",
+	},
+	{
+		name: "blank_line_argument",
+		src:  "x.map(e,\n\n  e + 1\n)",
+		want: "x.map(e,\n\n  e + 1\n)",
+	},
+	{
+		// Blank lines within an element are not kept.
+		name: "blank_line_operand",
+		src:  "{\n  \"a\":\n\n    x &&\n\n    y,\n}",
+		want: "{\n  \"a\": x && y,\n}",
+	},
+	{
+		// A comment ending the line of the target of a call
+		// breaks the chain.
+		name: "between_calls",
+		src:  "a\n  .b() // é\n  .c()",
+		want: "a\n  .b() // é\n  .c()",
+	},
+	{
+		name: "argument",
+		src:  "f(a, // one\n  b)",
+		want: "f(\n  a, // one\n  b\n)",
+	},
+	{
+		name: "operator",
+		src:  "a && // one\n  b",
+		want: "a && // one\nb",
+	},
+	{
+		name: "closing_bracket",
+		src:  "[\n  {\n    \"a\": 1,\n  }, // closing\n  2,\n]",
+		want: "[\n  {\n    \"a\": 1,\n  }, // closing\n  2,\n]",
+	},
+	{
+		name:        "index",
+		src:         "f(a[ // é\n  1])",
+		want:        "f(\n  a[1]\n)",
+		wantDropped: []DroppedComment{{Line: 1, Column: 6, Text: "// é"}},
+		wantErr:     "1:6: comment could not be placed: // é",
+	},
+}
+
+func TestDroppedComments(t *testing.T) {
+	for _, test := range droppedCommentsTests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFormatter(Options{Format: []FormatOption{Pretty(), AlwaysComma(), IndentString("  ")}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, report, err := f.FormatReport(test.src)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("unexpected result:\ngot: %q\nwant:%q", got, test.want)
+			}
+			if !slices.Equal(report.DroppedComments, test.wantDropped) {
+				t.Errorf("unexpected dropped comments: got:%+v want:%+v", report.DroppedComments, test.wantDropped)
+			}
+
+			_, err = FormatSource(test.src, Options{Format: []FormatOption{Pretty(), StrictComments()}})
+			var errText string
+			if err != nil {
+				errText = err.Error()
+			}
+			if errText != test.wantErr {
+				t.Errorf("unexpected strict error: got:%q want:%q", errText, test.wantErr)
+			}
+		})
+	}
+}
+
+// parseComments parses src for the comment map tests.
+func parseComments(t *testing.T, src string) (*ast.AST, common.Source) {
+	t.Helper()
+	p, err := parser.NewParser(parser.Macros(parser.AllMacros...), parser.PopulateMacroCalls(true), parser.EnableOptionalSyntax(true))
+	if err != nil {
+		t.Fatalf("failed to create parser: %v", err)
+	}
+	s := common.NewTextSource(src)
+	a, iss := p.Parse(s)
+	if len(iss.GetErrors()) != 0 {
+		t.Fatalf("unexpected parse error: %v", iss.ToDisplayString())
+	}
+	return a, s
+}
+
+// identID returns the ID of the identifier name in a.
+func identID(t *testing.T, a *ast.AST, name string) int64 {
+	t.Helper()
+	var id int64
+	ast.PreOrderVisit(a.Expr(), ast.NewExprVisitor(func(e ast.Expr) {
+		if e.Kind() == ast.IdentKind && e.AsIdent() == name {
+			id = e.ID()
+		}
+	}))
+	if id == 0 {
+		t.Fatalf("no identifier %s", name)
+	}
+	return id
+}
+
+func formatComments(t *testing.T, a *ast.AST, src common.Source, opts ...FormatOption) (string, []DroppedComment) {
+	t.Helper()
+	var (
+		buf     strings.Builder
+		dropped []DroppedComment
+	)
+	opts = append([]FormatOption{Pretty(), AlwaysComma(), IndentString("  "), DroppedComments(&dropped)}, opts...)
+	err := Format(&buf, a, src, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buf.String(), dropped
+}
+
+func TestCommentMap(t *testing.T) {
+	const src = "[\n  // lead\n\n  x, // trail\n  a[ // dangle\n    1],\n  y,\n] // end"
+	a, s := parseComments(t, src)
+	m := NewCommentMap(a, s)
+
+	x := m[identID(t, a, "x")]
+	wantLeading := []Comment{{Text: "// lead", Line: 2, Column: 3}, {Line: 3}}
+	if !slices.Equal(x.Leading, wantLeading) {
+		t.Errorf("unexpected leading comments: got:%+v want:%+v", x.Leading, wantLeading)
+	}
+	wantTrailing := []Comment{{Text: "// trail", Line: 4, Column: 6}}
+	if !slices.Equal(x.Trailing, wantTrailing) {
+		t.Errorf("unexpected trailing comments: got:%+v want:%+v", x.Trailing, wantTrailing)
+	}
+	root := m[a.Expr().ID()]
+	wantDangling := []Comment{{Text: "// end", Line: 8, Column: 3}}
+	if !slices.Equal(root.Dangling, wantDangling) {
+		t.Errorf("unexpected root dangling comments: got:%+v want:%+v", root.Dangling, wantDangling)
+	}
+	var dangling []Comment
+	for id, ec := range m {
+		if id != a.Expr().ID() {
+			dangling = append(dangling, ec.Dangling...)
+		}
+	}
+	wantDangling = []Comment{{Text: "// dangle", Line: 5, Column: 6}}
+	if !slices.Equal(dangling, wantDangling) {
+		t.Errorf("unexpected dangling comments: got:%+v want:%+v", dangling, wantDangling)
+	}
+	var all []string
+	for _, c := range m.Comments() {
+		all = append(all, c.Text)
+	}
+	wantAll := []string{"// lead", "// trail", "// dangle", "// end"}
+	if !slices.Equal(all, wantAll) {
+		t.Errorf("unexpected comments: got:%q want:%q", all, wantAll)
+	}
+
+	// Formatting with the map places comments as they are placed
+	// from the source.
+	want, wantDropped := formatComments(t, a, s)
+	got, dropped := formatComments(t, a, s, Comments(m))
+	if got != want {
+		t.Errorf("unexpected result with comment map:\ngot: %q\nwant:%q", got, want)
+	}
+	if !slices.Equal(dropped, wantDropped) {
+		t.Errorf("unexpected dropped comments with comment map: got:%+v want:%+v", dropped, wantDropped)
+	}
+
+	// Comments follow their expression when the map is updated.
+	m.Update(identID(t, a, "x"), identID(t, a, "y"))
+	m[-1] = ExprComments{Leading: []Comment{{Text: "// orphan"}}}
+	got, dropped = formatComments(t, a, s, Comments(m))
+	const wantUpdated = "[\n  x,\n  a[1],\n  // lead\n\n  y, // trail\n] // end"
+	if got != wantUpdated {
+		t.Errorf("unexpected result with updated comment map:\ngot: %q\nwant:%q", got, wantUpdated)
+	}
+	wantDropped = []DroppedComment{{Text: "// dangle", Line: 5, Column: 6}, {Text: "// orphan"}}
+	if !slices.Equal(dropped, wantDropped) {
+		t.Errorf("unexpected dropped comments with updated comment map: got:%+v want:%+v", dropped, wantDropped)
+	}
+}
+
+func TestCommentMapRoundTrip(t *testing.T) {
+	for _, test := range droppedCommentsTests {
+		t.Run(test.name, func(t *testing.T) {
+			a, s := parseComments(t, test.src)
+			want, wantDropped := formatComments(t, a, s)
+			got, dropped := formatComments(t, a, s, Comments(NewCommentMap(a, s)))
+			if got != want {
+				t.Errorf("unexpected result with comment map:\ngot: %q\nwant:%q", got, want)
+			}
+			if !slices.Equal(dropped, wantDropped) {
+				t.Errorf("unexpected dropped comments with comment map: got:%+v want:%+v", dropped, wantDropped)
+			}
+		})
+	}
+}
+
+func TestAlignComments(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		indent    string
+		unaligned bool
+		want      string
+	}{
+		{
+			name: "block",
+			src:  "{\n  \"a\": 1, // one\n  \"bébé\": [1, 2], // two\n  \"c\": 3,\n  \"d\": 4, // four\n  \"eff\": 5, // five\n}",
+			want: "{\n  \"a\": 1,         // one\n  \"bébé\": [1, 2], // two\n  \"c\": 3,\n  \"d\": 4,   // four\n  \"eff\": 5, // five\n}",
+		},
+		{
+			// Lines with different indentation are aligned
+			// separately.
+			name:   "indent",
+			src:    "{\n  \"a\": 1, // one\n  \"gee\": false ? // cond\n    \"yes\" // yes\n  :\n    \"no\", // no\n}",
+			indent: "\t",
+			want:   "{\n\t\"a\": 1,        // one\n\t\"gee\": false ? // cond\n\t\t\"yes\" // yes\n\t:\n\t\t\"no\", // no\n}",
+		},
+		{
+			name:      "unaligned",
+			src:       "{\n  \"a\": 1,   // one\n  \"bébé\": [1, 2], // two\n}",
+			unaligned: true,
+			want:      "{\n  \"a\": 1, // one\n  \"bébé\": [1, 2], // two\n}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indent := "  "
+			if test.indent != "" {
+				indent = test.indent
+			}
+			opts := []FormatOption{Pretty(), AlwaysComma(), IndentString(indent)}
+			if test.unaligned {
+				opts = append(opts, AlignComments(false))
+			}
+			got, err := FormatSource(test.src, Options{Format: opts})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("unexpected result:\ngot: %q\nwant:%q", got, test.want)
+			}
+			again, err := FormatSource(got, Options{Format: opts})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if again != got {
+				t.Errorf("unstable result:\ngot: %q\nwant:%q", again, got)
+			}
+		})
+	}
+}
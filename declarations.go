@@ -0,0 +1,225 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+	"gopkg.in/yaml.v3"
+
+	"github.com/elastic/celfmt/mitoenv"
+	"github.com/elastic/celfmt/profiles"
+)
+
+// Declarations describes the environment that CEL programs are checked
+// against: the environment profile, the variables that are declared and,
+// for the mito profile, the mito extension libraries that are enabled.
+// Declarations are usually read from a YAML or JSON file with
+// ParseDeclarations.
+//
+// An example declarations file:
+//
+//	profile: mito
+//	variables:
+//	  state: dyn
+//	  useragent: string
+//	  allowed: list(string)
+//	libraries: [collections, http, json, strings, time]
+type Declarations struct {
+	// Profile is the name of the environment profile, as listed by
+	// profiles.Names. If empty, the mito profile is used.
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+
+	// Variables maps variable names to their types. Types are
+	// written as in CEL type checker messages, for example dyn,
+	// string, list(string) or map(string, dyn). If nil, the
+	// profile's default variables are declared.
+	Variables map[string]string `yaml:"variables,omitempty" json:"variables,omitempty"`
+
+	// Libraries lists the names of the mito extension libraries to
+	// enable, as listed by mitoenv.LibraryNames. If nil, all libraries
+	// are enabled. Libraries may only be listed for the mito profile.
+	Libraries []string `yaml:"libraries,omitempty" json:"libraries,omitempty"`
+
+	// Check specifies that programs must type-check in the declared
+	// environment wherever the declarations are used, as if the
+	// Check option were set. Otherwise programs only need to parse.
+	Check bool `yaml:"check,omitempty" json:"check,omitempty"`
+}
+
+// DefaultDeclarations returns the declarations for programs run by the
+// Elastic Agent CEL input: the state and useragent variables and all mito
+// extension libraries.
+func DefaultDeclarations() *Declarations {
+	return &Declarations{
+		Variables: map[string]string{
+			"state":     "dyn",
+			"useragent": "string",
+		},
+	}
+}
+
+// ParseDeclarations parses declarations from YAML or JSON data. Unknown
+// fields are an error.
+func ParseDeclarations(data []byte) (*Declarations, error) {
+	var d Declarations
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&d)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid declarations: %w", err)
+	}
+	return &d, nil
+}
+
+// NewEnv returns a CEL environment for the declared profile holding the
+// declared variables and libraries, with macro call tracking enabled as
+// required by Format. Any opts are applied after the declarations.
+func (d *Declarations) NewEnv(opts ...cel.EnvOption) (*cel.Env, error) {
+	var vars []*decls.VariableDecl
+	if d.Variables != nil {
+		vars = make([]*decls.VariableDecl, 0, len(d.Variables))
+	}
+	for _, name := range slices.Sorted(maps.Keys(d.Variables)) {
+		typ, err := parseType(d.Variables[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid type for variable %s: %w", name, err)
+		}
+		vars = append(vars, decls.NewVariable(name, typ))
+	}
+	profile := d.Profile
+	if profile == "" {
+		profile = profiles.Mito
+	}
+	if d.Libraries == nil {
+		return profiles.New(profile, vars, opts...)
+	}
+	if profile != profiles.Mito {
+		return nil, fmt.Errorf("libraries cannot be selected for the %s profile", profile)
+	}
+	envOpts := []mitoenv.Option{
+		mitoenv.Libraries(d.Libraries...),
+		mitoenv.EnvOptions(opts...),
+	}
+	if vars != nil {
+		envOpts = append(envOpts, mitoenv.Variables(vars...))
+	}
+	env, err := mitoenv.New(envOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return env.Env, nil
+}
+
+// simpleTypes holds the types that take no parameters by name.
+var simpleTypes = map[string]*types.Type{
+	"dyn":       types.DynType,
+	"any":       types.AnyType,
+	"bool":      types.BoolType,
+	"int":       types.IntType,
+	"uint":      types.UintType,
+	"double":    types.DoubleType,
+	"string":    types.StringType,
+	"bytes":     types.BytesType,
+	"null_type": types.NullType,
+	"timestamp": types.TimestampType,
+	"duration":  types.DurationType,
+	"type":      types.TypeType,
+}
+
+// parseType returns the type described by s.
+func parseType(s string) (*types.Type, error) {
+	s = strings.TrimSpace(s)
+	if t, ok := simpleTypes[s]; ok {
+		return t, nil
+	}
+	name, params, ok := strings.Cut(s, "(")
+	if !ok || !strings.HasSuffix(params, ")") {
+		return nil, fmt.Errorf("unknown type: %q", s)
+	}
+	args, err := splitTypeParams(strings.TrimSuffix(params, ")"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid type %q: %w", s, err)
+	}
+	var want int
+	switch strings.TrimSpace(name) {
+	case "list", "optional_type":
+		want = 1
+	case "map":
+		want = 2
+	default:
+		return nil, fmt.Errorf("unknown type: %q", s)
+	}
+	if len(args) != want {
+		return nil, fmt.Errorf("invalid type %q: want %d type parameters", s, want)
+	}
+	typs := make([]*types.Type, len(args))
+	for i, a := range args {
+		typs[i], err = parseType(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch strings.TrimSpace(name) {
+	case "list":
+		return types.NewListType(typs[0]), nil
+	case "optional_type":
+		return types.NewOptionalType(typs[0]), nil
+	default:
+		return types.NewMapType(typs[0], typs[1]), nil
+	}
+}
+
+// splitTypeParams splits a comma-separated list of type parameters,
+// respecting nested parentheses.
+func splitTypeParams(s string) ([]string, error) {
+	var (
+		params []string
+		depth  int
+		last   int
+	)
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("unbalanced parentheses")
+			}
+		case ',':
+			if depth == 0 {
+				params = append(params, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses")
+	}
+	return append(params, s[last:]), nil
+}
@@ -0,0 +1,141 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"strings"
+	"testing"
+)
+
+var declarationsTests = []struct {
+	name     string
+	decls    string
+	src      string
+	wantErr  string
+	checkErr string
+}{
+	{
+		name:  "default",
+		decls: "",
+		src:   `state.with({"ua": useragent + "/1"})`,
+	},
+	{
+		name: "yaml",
+		decls: `
+variables:
+  allowed: list(string)
+  counts: map(string, list(int))
+libraries: [collections, strings]
+`,
+		src: `allowed.map(a, a.to_upper()).zip(counts.map(k, counts[k].sum()))`,
+	},
+	{
+		name:  "json",
+		decls: `{"variables": {"n": "int"}, "libraries": []}`,
+		src:   `n + 1`,
+	},
+	{
+		name:     "type_mismatch",
+		decls:    `{"variables": {"n": "string"}}`,
+		src:      `n + 1`,
+		checkErr: "found no matching overload for '_+_'",
+	},
+	{
+		name:     "library_not_enabled",
+		decls:    `libraries: [strings]`,
+		src:      `now()`,
+		checkErr: "undeclared reference to 'now'",
+	},
+	{
+		name:  "profile",
+		decls: `{"profile": "k8s", "variables": {"object": "dyn"}}`,
+		src:   `object.spec.containers.all(c, isURL(c.registry))`,
+	},
+	{
+		name:     "profile_variables",
+		decls:    `{"profile": "k8s", "variables": {"object": "dyn"}}`,
+		src:      `params.limit`,
+		checkErr: "undeclared reference to 'params'",
+	},
+	{
+		name:    "profile_libraries",
+		decls:   `{"profile": "cel-std", "libraries": ["strings"]}`,
+		wantErr: "libraries cannot be selected for the cel-std profile",
+	},
+	{
+		name:    "unknown_profile",
+		decls:   `profile: k9s`,
+		wantErr: "unknown profile: k9s",
+	},
+	{
+		name:    "unknown_library",
+		decls:   `libraries: [nope]`,
+		wantErr: "unknown library: nope",
+	},
+	{
+		name:    "bad_type",
+		decls:   `variables: {n: "list(int"}`,
+		wantErr: `invalid type for variable n: unknown type: "list(int"`,
+	},
+	{
+		name:    "bad_arity",
+		decls:   `variables: {n: "map(int)"}`,
+		wantErr: `invalid type for variable n: invalid type "map(int)": want 2 type parameters`,
+	},
+	{
+		name:    "unknown_field",
+		decls:   `variable: {n: int}`,
+		wantErr: "field variable not found",
+	},
+}
+
+func TestDeclarations(t *testing.T) {
+	for _, test := range declarationsTests {
+		t.Run(test.name, func(t *testing.T) {
+			d := DefaultDeclarations()
+			if test.decls != "" {
+				var err error
+				d, err = ParseDeclarations([]byte(test.decls))
+				if err != nil {
+					if test.wantErr == "" || !strings.Contains(err.Error(), test.wantErr) {
+						t.Fatalf("unexpected error parsing declarations: got:%v want:%q", err, test.wantErr)
+					}
+					return
+				}
+			}
+			env, err := d.NewEnv()
+			if err != nil {
+				if test.wantErr == "" || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("unexpected error creating env: got:%v want:%q", err, test.wantErr)
+				}
+				return
+			}
+			if test.wantErr != "" {
+				t.Fatalf("expected error: %q", test.wantErr)
+			}
+			_, iss := env.Compile(test.src)
+			var got string
+			if iss.Err() != nil {
+				got = iss.Err().Error()
+			}
+			if test.checkErr == "" && got != "" || !strings.Contains(got, test.checkErr) {
+				t.Errorf("unexpected check error: got:%q want:%q", got, test.checkErr)
+			}
+		})
+	}
+}
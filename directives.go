@@ -0,0 +1,525 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/common/ast"
+)
+
+// Formatter directives. A directive is a comment holding only the
+// directive, optionally followed by an explanation.
+const (
+	directiveOff    = "celfmt:off"    // start copying the source verbatim
+	directiveOn     = "celfmt:on"     // stop copying the source verbatim
+	directiveIgnore = "celfmt:ignore" // copy the next expression verbatim
+)
+
+// directive returns the formatter directive held in the comment text, or
+// the empty string if it holds none.
+func directive(text string) string {
+	f := strings.Fields(strings.TrimPrefix(text, "//"))
+	if len(f) == 0 {
+		return ""
+	}
+	switch f[0] {
+	case directiveOff, directiveOn, directiveIgnore:
+		return f[0]
+	default:
+		return ""
+	}
+}
+
+// directives finds the regions protected by celfmt:off and celfmt:on, and
+// the celfmt:ignore directives. A region that is not closed extends to the
+// end of the source, and directives that do not open or close a region are
+// ignored.
+func (t *sourceText) directives() {
+	off := -1
+	for i, c := range t.comments {
+		switch directive(c.text) {
+		case directiveOff:
+			if off < 0 {
+				off = c.offset + len(c.text)
+			}
+		case directiveOn:
+			if off >= 0 {
+				t.off = append(t.off, span{off, c.offset})
+				off = -1
+			}
+		case directiveIgnore:
+			t.ignores = append(t.ignores, i)
+		}
+	}
+	if off >= 0 {
+		t.off = append(t.off, span{off, len(t.src)})
+	}
+}
+
+// protector finds the extents of the parts of a program that are protected
+// from formatting by directives.
+type protector struct {
+	*extents
+
+	// regions holds the protected parts of the source, and ignores
+	// holds the offsets of the celfmt:ignore directives that protect
+	// a unit.
+	regions []region
+	ignores map[int]bool
+}
+
+// region is a part of the source that is protected from formatting: the
+// text between celfmt:off and celfmt:on directives, or a celfmt:ignore
+// directive and the unit following it.
+type region struct {
+	span
+
+	// ignore is the celfmt:ignore directive of the region, or nil
+	// for regions between celfmt:off and celfmt:on.
+	ignore *sourceComment
+}
+
+// unit is a part of a program that is formatted as a whole: an expression,
+// a list element, a map entry or a struct field.
+type unit struct {
+	exprs []ast.Expr
+
+	// ids holds the IDs of parts of the unit that are not
+	// expressions, such as the field of a struct field.
+	ids []int64
+
+	// optional is whether the unit is marked optional by a "?".
+	optional bool
+}
+
+// newProtector returns a protector for the AST a and its lexed source, or
+// nil if the source holds no directives.
+func newProtector(a *ast.AST, text *sourceText) *protector {
+	if len(text.off) == 0 && len(text.ignores) == 0 {
+		return nil
+	}
+	p := &protector{
+		extents: newExtents(a, text),
+		ignores: make(map[int]bool),
+	}
+	for _, s := range text.off {
+		p.regions = append(p.regions, region{span: s})
+	}
+	if len(text.ignores) == 0 {
+		return p
+	}
+	// Each celfmt:ignore directive protects the largest unit that
+	// starts at the first token following it.
+	starts := make([]int, len(text.ignores))
+	for i, c := range text.ignores {
+		end := text.comments[c].offset + len(text.comments[c].text)
+		tok := sort.Search(len(text.tokens), func(j int) bool { return text.tokens[j].start >= end })
+		starts[i] = -1
+		if tok < len(text.tokens) {
+			starts[i] = text.tokens[tok].start
+		}
+	}
+	ignored := make([]span, len(text.ignores))
+	for _, u := range units(a.Expr()) {
+		s, ok := p.extent(u)
+		if !ok {
+			continue
+		}
+		for i, start := range starts {
+			if start == s.start && s.end > ignored[i].end {
+				ignored[i] = s
+			}
+		}
+	}
+	for i, s := range ignored {
+		if s.end == 0 {
+			continue
+		}
+		c := &text.comments[text.ignores[i]]
+		p.ignores[c.offset] = true
+		p.regions = append(p.regions, region{span: span{c.offset, s.end}, ignore: c})
+	}
+	return p
+}
+
+// units returns the units of the expression e and its descendants.
+func units(e ast.Expr) []unit {
+	var all []unit
+	ast.PreOrderVisit(e, ast.NewExprVisitor(func(e ast.Expr) {
+		all = append(all, unit{exprs: []ast.Expr{e}})
+		switch e.Kind() {
+		case ast.ListKind:
+			l := e.AsList()
+			for _, i := range l.OptionalIndices() {
+				all = append(all, unit{exprs: []ast.Expr{l.Elements()[i]}, optional: true})
+			}
+		case ast.MapKind:
+			for _, entry := range e.AsMap().Entries() {
+				all = append(all, mapUnit(entry))
+			}
+		case ast.StructKind:
+			for _, field := range e.AsStruct().Fields() {
+				all = append(all, fieldUnit(field))
+			}
+		}
+	}))
+	return all
+}
+
+// mapUnit returns the unit of a map entry.
+func mapUnit(e ast.EntryExpr) unit {
+	entry := e.AsMapEntry()
+	return unit{exprs: []ast.Expr{entry.Key(), entry.Value()}, optional: entry.IsOptional()}
+}
+
+// fieldUnit returns the unit of a struct field.
+func fieldUnit(f ast.EntryExpr) unit {
+	field := f.AsStructField()
+	return unit{exprs: []ast.Expr{field.Value()}, ids: []int64{f.ID()}, optional: field.IsOptional()}
+}
+
+// region returns the index of the protected region holding all of s, or -1
+// if there is none. A nil protector protects nothing.
+func (p *protector) region(s span) int {
+	if p == nil {
+		return -1
+	}
+	for i, r := range p.regions {
+		if r.span.contains(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// protected returns the extent of the unit u and the index of the protected
+// region holding it, or false if it is not protected.
+func (p *protector) protected(u unit) (span, int, bool) {
+	if p == nil {
+		return span{}, -1, false
+	}
+	s, ok := p.extent(u)
+	if !ok {
+		return span{}, -1, false
+	}
+	r := p.region(s)
+	return s, r, r >= 0
+}
+
+// overlaps returns whether any part of the expression e is protected, or
+// its extent cannot be found.
+func (p *protector) overlaps(e ast.Expr) bool {
+	if p == nil {
+		return false
+	}
+	s, ok := p.extent(unit{exprs: []ast.Expr{e}})
+	if !ok {
+		return true
+	}
+	for _, r := range p.regions {
+		if r.span.overlaps(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// extents finds the extents in the source of the parts of a program.
+type extents struct {
+	text *sourceText
+	info *ast.SourceInfo
+
+	// offsets holds the byte offset of each code point in the source
+	// when the source is not ASCII.
+	offsets []int
+}
+
+// newExtents returns an extents for the AST a and its lexed source.
+func newExtents(a *ast.AST, text *sourceText) *extents {
+	x := &extents{text: text, info: a.SourceInfo()}
+	if utf8.RuneCountInString(text.src) != len(text.src) {
+		for i := range text.src {
+			x.offsets = append(x.offsets, i)
+		}
+	}
+	return x
+}
+
+// extent returns the extent in the source of the unit u. The AST only
+// holds the position of one token of each expression, so the extent is
+// found by extending the positions of the unit's expressions over the
+// source's tokens to balance brackets and complete operands. Only the
+// starts of the positions are used since their stops count bytes past
+// their starts, which count code points.
+func (x *extents) extent(u unit) (span, bool) {
+	lo, hi := int32(-1), int32(-1)
+	add := func(id int64) {
+		r, ok := x.info.GetOffsetRange(id)
+		if !ok {
+			return
+		}
+		if lo < 0 || r.Start < lo {
+			lo = r.Start
+		}
+		hi = max(hi, r.Start)
+	}
+	for _, id := range u.ids {
+		add(id)
+	}
+	for _, e := range u.exprs {
+		ast.PreOrderVisit(e, ast.NewExprVisitor(func(e ast.Expr) { add(e.ID()) }))
+	}
+	if lo < 0 {
+		return span{}, false
+	}
+	src, toks := x.text.src, x.text.tokens
+	start, stop := x.offset(lo), x.offset(hi)
+	first := sort.Search(len(toks), func(i int) bool { return toks[i].start >= start })
+	if first == len(toks) {
+		return span{}, false
+	}
+	last := max(first, sort.Search(len(toks), func(i int) bool { return toks[i].start > stop })-1)
+
+	// Extend forward until brackets opened within the unit are closed
+	// and the unit ends with an operand or a closing bracket, counting
+	// the closing brackets of groups that open before the unit.
+	var depth, open int
+	nest := func(i int) {
+		switch src[toks[i].start] {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				open++
+			} else {
+				depth--
+			}
+		}
+	}
+	for i := first; i <= last; i++ {
+		nest(i)
+	}
+	for depth > 0 || !x.operand(toks[last]) {
+		last++
+		if last == len(toks) {
+			return span{}, false
+		}
+		nest(last)
+	}
+
+	// Extend backward over the opening parentheses of groups, the
+	// names of functions and message types, struct field names and
+	// optional markers.
+	for ; open > 0; open-- {
+		if first == 0 || src[toks[first-1].start] != '(' {
+			return span{}, false
+		}
+		first--
+	}
+	switch src[toks[first].start] {
+	case '(', '{':
+		for first > 0 && (src[toks[first-1].start] == '.' || x.name(toks[first-1])) {
+			first--
+		}
+	case ':':
+		if first > 0 && x.name(toks[first-1]) {
+			first--
+		}
+	}
+	if u.optional && first > 0 && src[toks[first-1].start] == '?' {
+		first--
+	}
+	return span{toks[first].start, toks[last].end}, true
+}
+
+// offset returns the byte offset of the code point offset i.
+func (x *extents) offset(i int32) int {
+	switch {
+	case x.offsets == nil:
+		return int(i)
+	case int(i) < len(x.offsets):
+		return x.offsets[i]
+	default:
+		return len(x.text.src)
+	}
+}
+
+// operand returns whether the token may end an expression: an identifier,
+// a literal or a closing bracket.
+func (x *extents) operand(tok span) bool {
+	switch c := x.text.src[tok.start]; {
+	case isIdentPart(c), c == '"', c == '\'', c == '`', c == ')', c == ']', c == '}':
+		return true
+	default:
+		// A floating point literal may start with a ".".
+		return c == '.' && tok.end-tok.start > 1
+	}
+}
+
+// ignoring returns whether the comment at the byte offset i is a
+// celfmt:ignore directive that protects a unit. Such directives are written
+// with the unit they protect rather than being attached to other
+// expressions.
+func (p *protector) ignoring(i int) bool {
+	return p != nil && p.ignores[i]
+}
+
+// name returns whether the token is an identifier other than the in
+// operator, or a quoted field name.
+func (x *extents) name(tok span) bool {
+	text := x.text.src[tok.start:tok.end]
+	return isIdentStart(text[0]) && text != "in" || text[0] == '`'
+}
+
+// writeProtected writes the unit units[i] verbatim if it is protected by a
+// directive, together with the units following it that are protected by the
+// same region, and returns the number of units written. The separators and
+// comments between the units are written as they are in the source.
+func (un *formatter) writeProtected(units []unit, i int) int {
+	s, r, ok := un.protect.protected(units[i])
+	if !ok {
+		return 0
+	}
+	n := 1
+	for ; i+n < len(units); n++ {
+		next, nr, ok := un.protect.protected(units[i+n])
+		if !ok || nr != r {
+			break
+		}
+		s.end = next.end
+	}
+	// The comments preceding the protected text are written as
+	// usual, followed by any celfmt:ignore directive on a line of
+	// its own.
+	id := units[i].exprs[0].ID()
+	reg := un.protect.regions[r]
+	line, claim := un.text.line(s.start), s
+	if reg.ignore != nil {
+		line, claim.start = reg.ignore.line, reg.ignore.offset
+	}
+	un.writeCommentLines(un.commentBlock(id, line-1, false))
+	un.claimSpan(id, claim)
+	if reg.ignore != nil {
+		un.WriteString(normalizeComment(reg.ignore.text))
+		un.WriteNewLine()
+	}
+	un.writeVerbatim(s)
+	return n
+}
+
+// writeVerbatim writes the source text of s.
+func (un *formatter) writeVerbatim(s span) {
+	text := un.text.src[s.start:s.end]
+	un.add(docVerbatim(text))
+	un.between = false
+	if strings.Contains(text, "\n") {
+		un.cur().hard = true
+	}
+}
+
+// claimSpan marks the comments within s as written. Comments from the
+// source are claimed by the expression with the given ID, and comments
+// from a comment map are written if they are all within s.
+func (un *formatter) claimSpan(id int64, s span) {
+	if un.cmap != nil {
+		within := func(c Comment) bool {
+			i, ok := un.text.offset(c)
+			return ok && s.holds(i)
+		}
+		for cid, ec := range un.cmap {
+			for kind, list := range map[CommentKind][]Comment{
+				LeadingComment:  ec.Leading,
+				TrailingComment: ec.Trailing,
+				DanglingComment: ec.Dangling,
+			} {
+				if slices.ContainsFunc(list, func(c Comment) bool { return c.Text != "" }) &&
+					!slices.ContainsFunc(list, func(c Comment) bool { return c.Text != "" && !within(c) }) {
+					un.emitted[commentKey{cid, kind}] = true
+				}
+			}
+		}
+		return
+	}
+	var claimed []Comment
+	for _, c := range un.text.comments {
+		loc := location{c.line, c.col}
+		if !s.holds(c.offset) {
+			continue
+		}
+		if _, ok := un.comments[loc]; ok {
+			continue
+		}
+		un.comments[loc] = id
+		claimed = append(claimed, c.comment())
+	}
+	un.recordComments(id, DanglingComment, claimed...)
+}
+
+// writeClosingDirectives writes the directives that follow the last unit of
+// the multi-line list, map or struct expr before its closing bracket, which
+// have no expression to be attached to. Dropping them would change the
+// regions that are protected when the formatted text is formatted again.
+func (un *formatter) writeClosingDirectives(expr ast.Expr, last unit) {
+	if un.protect == nil {
+		return
+	}
+	outer, ok := un.protect.extent(unit{exprs: []ast.Expr{expr}})
+	if !ok {
+		return
+	}
+	inner, ok := un.protect.extent(last)
+	if !ok {
+		return
+	}
+	within := span{inner.end, outer.end}
+	if un.cmap != nil {
+		key := commentKey{expr.ID(), DanglingComment}
+		dangling := un.cmap[expr.ID()].Dangling
+		if un.emitted[key] || len(dangling) == 0 || slices.ContainsFunc(dangling, func(c Comment) bool {
+			i, ok := un.text.offset(c)
+			return !ok || !within.holds(i) || directive(c.Text) == ""
+		}) {
+			return
+		}
+		un.emitted[key] = true
+		for _, c := range dangling {
+			un.WriteNewLine()
+			un.WriteString(normalizeComment(c.Text))
+		}
+		return
+	}
+	var directives []Comment
+	for _, c := range un.text.comments {
+		loc := location{c.line, c.col}
+		if !within.holds(c.offset) || directive(c.text) == "" {
+			continue
+		}
+		if _, ok := un.comments[loc]; ok {
+			continue
+		}
+		un.comments[loc] = expr.ID()
+		directives = append(directives, c.comment())
+		un.WriteNewLine()
+		un.WriteString(normalizeComment(c.text))
+	}
+	un.recordComments(expr.ID(), DanglingComment, directives...)
+}
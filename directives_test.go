@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"testing"
+)
+
+var directivesTests = []struct {
+	name string
+	src  string
+	want string
+}{
+	{
+		name: "none",
+		src:  "[\n  // celfmt:offline\n  1,  2,\n]",
+		want: "[\n  // celfmt:offline\n  1,\n  2,\n]",
+	},
+	{
+		name: "off_on",
+		src:  "{\n  \"a\":   1,\n  // celfmt:off\n  \"b\": [\n    1,  0,\n    0,  1,\n  ],\n  \"c\":{\"x\":1},  // c\n  // celfmt:on\n  \"d\":   2,\n}",
+		want: "{\n  \"a\": 1,\n  // celfmt:off\n  \"b\": [\n    1,  0,\n    0,  1,\n  ],\n  \"c\":{\"x\":1}, // c\n  // celfmt:on\n  \"d\": 2,\n}",
+	},
+	{
+		name: "off_to_end",
+		src:  "// celfmt:off\nx.map(y,   y+1)\n// end",
+		want: "// celfmt:off\nx.map(y,   y+1)\n// end",
+	},
+	{
+		name: "on_before_bracket",
+		src:  "[\n  1,\n  // celfmt:off\n  f(x,   y), // f\n  // celfmt:on\n]",
+		want: "[\n  1,\n  // celfmt:off\n  f(x,   y), // f\n  // celfmt:on\n]",
+	},
+	{
+		name: "ignore",
+		src:  "[\n  // lead\n  // celfmt:ignore keep the table\n  [1,0,\n   0,1],\n  [1,0,\n   0,1],\n]",
+		want: "[\n  // lead\n  // celfmt:ignore keep the table\n  [1,0,\n   0,1],\n  [\n    1,\n    0,\n    0,\n    1,\n  ],\n]",
+	},
+	{
+		name: "ignore_macro",
+		src:  "// celfmt:ignore\n[1,2,\n  3].map(x,  x+1)",
+		want: "// celfmt:ignore\n[1,2,\n  3].map(x,  x+1)",
+	},
+	{
+		name: "ignore_operand",
+		src:  "a &&\n// celfmt:ignore\nf(  \"é\",  (b  ||  c) ) && d",
+		want: "a && // celfmt:ignore\nf(  \"é\",  (b  ||  c) ) && d",
+	},
+	{
+		name: "ignore_after_element",
+		src:  "[\n  1, // celfmt:ignore\n  -1.5e3,\n  2.50,\n]",
+		want: "[\n  1,\n  // celfmt:ignore\n  -1.5e3,\n  2.5,\n]",
+	},
+	{
+		name: "ignore_fields",
+		src:  "pkg.Msg{\n  // celfmt:ignore\n  ?f:   [1,2],\n  g:   a.b,\n  // celfmt:ignore\n  h:   a.b,\n}",
+		want: "pkg.Msg{\n  // celfmt:ignore\n  ?f:   [1,2],\n  g: a.b,\n  // celfmt:ignore\n  h:   a.b,\n}",
+	},
+}
+
+func TestDirectives(t *testing.T) {
+	for _, test := range directivesTests {
+		t.Run(test.name, func(t *testing.T) {
+			a, s := parseComments(t, test.src)
+			got, dropped := formatComments(t, a, s)
+			if got != test.want {
+				t.Errorf("unexpected result:\ngot: %q\nwant:%q", got, test.want)
+			}
+			if len(dropped) != 0 {
+				t.Errorf("unexpected dropped comments: %+v", dropped)
+			}
+
+			// Formatting with a comment map places comments as they
+			// are placed from the source.
+			got, dropped = formatComments(t, a, s, Comments(NewCommentMap(a, s)))
+			if got != test.want {
+				t.Errorf("unexpected result with comment map:\ngot: %q\nwant:%q", got, test.want)
+			}
+			if len(dropped) != 0 {
+				t.Errorf("unexpected dropped comments with comment map: %+v", dropped)
+			}
+
+			a, s = parseComments(t, test.want)
+			got, _ = formatComments(t, a, s)
+			if got != test.want {
+				t.Errorf("result is not stable:\ngot: %q\nwant:%q", got, test.want)
+			}
+		})
+	}
+}
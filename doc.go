@@ -0,0 +1,548 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A doc is a node of the document a formatter builds while visiting an
+// expression, in the manner of Wadler's "A prettier printer". The text and
+// line breaks of a document are collected into groups, and a group is laid
+// out either flat, with its line breaks written as their flat text, or
+// broken, with each of its line breaks starting a new line. Which of the
+// two is chosen depends on the LayoutMode, and is made when the document
+// is rendered so that it may depend on the width of the output.
+//
+// A doc is one of docText, docVerbatim, docComment, docLine, docWrap,
+// docIf or *docGroup.
+type doc any
+
+// docText is text that is written as it is.
+type docText string
+
+// docVerbatim is source text that is written as it is. Operator wrapping
+// is relative to the start of its last line.
+type docVerbatim string
+
+// docComment is a trailing comment, including the space preceding it,
+// which ends the line it is written on.
+type docComment string
+
+// docLine is a line break. When its group is flat, the flat text is
+// written in its place unless the line break is hard.
+type docLine struct {
+	indent int // indentation of the following line
+	flat   string
+	hard   bool
+}
+
+// docWrap is a binary operator that is wrapped onto a new line when the
+// operator is configured for wrapping and the line reaches the wrap column.
+// It is always wrapped when it holds the trailing comment of its lhs
+// operand, which ends the line.
+type docWrap struct {
+	fun, op string
+	indent  int // indentation of the line following a wrap
+	comment string
+}
+
+// docIf is the doc written in place of the broken doc when its group is
+// flat. Either may be nil.
+type docIf struct {
+	broken, flat doc
+}
+
+// docGroup is a group of docs that is laid out flat or broken as a whole.
+type docGroup struct {
+	docs []doc
+
+	// broken is whether the source layout breaks the group, which is
+	// when the expression spans more than one line of the source. It
+	// is disregarded in the CanonicalLayout mode.
+	broken bool
+
+	// hard is whether the group must be broken because it holds a
+	// hard line break or a group that is written over more than one
+	// line.
+	hard bool
+
+	// chain is whether the group is a chain of member calls. When a
+	// chain is broken, each call is on a line of its own and indented
+	// after the first line break. The argument list of the last call
+	// of a chain, which is the group marked tail, may be broken while
+	// the chain is flat, and lines holds whether it must be.
+	chain bool
+	tail  bool
+	lines bool
+
+	// nest is whether the group is a nest rather than a group of its
+	// own. A nest is laid out as the group holding it is, with its
+	// line breaks indented by one more level when broken.
+	nest bool
+}
+
+// must returns whether the group is broken whatever the width of the
+// output in the layout mode m.
+func (g *docGroup) must(m LayoutMode) bool {
+	return g.hard || m == WidthLayout && g.broken
+}
+
+// multiline returns whether the group is written over more than one line
+// whatever the width of the output in the layout mode m.
+func (g *docGroup) multiline(m LayoutMode) bool {
+	return g.must(m) || g.lines
+}
+
+// cur returns the innermost open group.
+func (un *formatter) cur() *docGroup {
+	return un.docs[len(un.docs)-1]
+}
+
+// add appends d to the innermost open group.
+func (un *formatter) add(d doc) {
+	g := un.cur()
+	g.docs = append(g.docs, d)
+}
+
+// openGroup opens a group that the source layout breaks if broken is true.
+func (un *formatter) openGroup(broken bool) *docGroup {
+	g := &docGroup{broken: broken}
+	un.add(g)
+	un.docs = append(un.docs, g)
+	return g
+}
+
+// openNest opens a nest within the innermost open group.
+func (un *formatter) openNest() {
+	g := &docGroup{nest: true}
+	un.add(g)
+	un.docs = append(un.docs, g)
+}
+
+// closeGroup closes the innermost open group or nest.
+func (un *formatter) closeGroup() {
+	g := un.cur()
+	un.docs = un.docs[:len(un.docs)-1]
+	p := un.cur()
+	m := g.multiline(un.options.layout)
+	if p.chain && g.tail {
+		p.lines = p.lines || m
+	} else {
+		p.hard = p.hard || m
+	}
+}
+
+// WriteLine writes a line break at the current indentation that is
+// written as flat when its group is flat.
+func (un *formatter) WriteLine(flat string) {
+	un.add(docLine{indent: un.indent, flat: flat})
+}
+
+// WriteIf writes broken when its group is broken and flat otherwise.
+func (un *formatter) WriteIf(broken, flat doc) {
+	un.add(docIf{broken: broken, flat: flat})
+}
+
+// writeComment writes the trailing comment of the expression with the
+// given ID, which ends the line it is written on.
+func (un *formatter) writeComment(id int64) {
+	un.writeTrailing(un.Comment(id))
+}
+
+// writeUnitComment writes the trailing comment of the unit u, which ends
+// the line it is written on.
+func (un *formatter) writeUnitComment(u unit) {
+	un.writeTrailing(un.unitComment(u, false, ","))
+}
+
+// writeTrailing writes the trailing comment c, if any, which ends the line
+// it is written on.
+func (un *formatter) writeTrailing(c string) {
+	if c != "" {
+		un.add(docComment(c))
+		un.commented()
+		un.between = false
+	}
+}
+
+// commented marks the innermost open group as holding a trailing comment,
+// which breaks it in every layout. The source layout only breaks groups
+// that are broken in the source, which those holding comments are unless
+// the program has been rewritten.
+func (un *formatter) commented() {
+	un.cur().hard = true
+	for i := len(un.docs) - 1; i >= 0; i-- {
+		if g := un.docs[i]; !g.nest {
+			g.broken = true
+			return
+		}
+	}
+}
+
+// renderer writes a document to a lenWriter.
+type renderer struct {
+	dst              *lenWriter
+	options          *unparserOption
+	lastWrappedIndex int
+
+	// align, if not nil, is the writer of dst, which records the
+	// trailing comments written so that they may be aligned.
+	align *commentAligner
+
+	// col is the width of the current line of the output.
+	col int
+
+	err error
+}
+
+// cmd is a doc to be rendered with the indentation of its lines offset
+// by level. A group in a flat cmd is flat unless it is the tail of a
+// chain and free is true, which is when the cmd is in a chain that fits
+// on its line with its tail broken.
+type cmd struct {
+	doc   doc
+	level int
+	flat  bool
+	free  bool
+}
+
+// render writes the docs of the root group g broken.
+func (r *renderer) render(g *docGroup) error {
+	cmds := r.push(nil, g, 0, false, false)
+	for len(cmds) != 0 && r.err == nil {
+		c := cmds[len(cmds)-1]
+		cmds = cmds[:len(cmds)-1]
+		switch d := c.doc.(type) {
+		case docText:
+			r.text(string(d))
+		case docVerbatim:
+			r.text(string(d))
+			if i := strings.LastIndexByte(string(d), '\n'); i >= 0 {
+				r.lastWrappedIndex = r.dst.Len() - (len(d) - i)
+			}
+		case docComment:
+			r.comment(string(d))
+		case docLine:
+			if c.flat && !d.hard {
+				if d.flat != "" {
+					r.text(d.flat)
+				}
+				continue
+			}
+			r.newLine(d.indent + c.level)
+		case docWrap:
+			r.wrap(d, c.level, cmds)
+		case docIf:
+			alt := d.broken
+			if c.flat {
+				alt = d.flat
+			}
+			if alt != nil {
+				c.doc = alt
+				cmds = append(cmds, c)
+			}
+		case *docGroup:
+			if d.nest {
+				level := c.level
+				if !c.flat {
+					level++
+				}
+				cmds = r.push(cmds, d, level, c.flat, false)
+				continue
+			}
+			flat, free := r.layout(d, c, cmds)
+			cmds = r.push(cmds, d, c.level, flat, free)
+		}
+	}
+	return r.err
+}
+
+// push appends the docs of g to cmds in reverse order, laid out flat or
+// broken.
+func (r *renderer) push(cmds []cmd, g *docGroup, level int, flat, free bool) []cmd {
+	indented := len(g.docs)
+	if g.chain && !flat {
+		for i, d := range g.docs {
+			if _, ok := d.(docLine); ok {
+				indented = i
+				break
+			}
+		}
+	}
+	for i := len(g.docs) - 1; i >= 0; i-- {
+		l := level
+		if i >= indented {
+			l++
+		}
+		cmds = append(cmds, cmd{doc: g.docs[i], level: l, flat: flat, free: free})
+	}
+	return cmds
+}
+
+// layout returns whether the group g of the cmd c is flat given the cmds
+// that follow it, and whether its tail is free to be broken if it is a
+// flat chain.
+func (r *renderer) layout(g *docGroup, c cmd, rest []cmd) (flat, free bool) {
+	m := r.options.layout
+	switch {
+	case m == SourceLayout:
+		return !g.broken, false
+	case g.must(m):
+		return false, false
+	case c.flat && !(c.free && g.tail):
+		return true, false
+	default:
+		flat = r.fits(g, rest)
+		return flat, flat && g.chain
+	}
+}
+
+// fits returns whether the group g fits on the current line when it is
+// flat, together with the text following it up to the next line break
+// in the cmds that follow it. The tail of a chain is assumed to be broken
+// when the chain is g, so that a chain is only broken when the text before
+// the argument list of its last call is too long. Operators that may be
+// wrapped are taken to be line breaks in the cmds that follow g, but not
+// within g, which is broken rather than wrapped when it does not fit.
+func (r *renderer) fits(g *docGroup, rest []cmd) bool {
+	type item struct {
+		doc  doc
+		flat bool
+		free bool
+		rest bool
+	}
+	m := r.options.layout
+	width := r.options.wrapOnColumn - r.col
+	stack := []item{{doc: g, flat: true}}
+	for width >= 0 {
+		if len(stack) == 0 {
+			if len(rest) == 0 {
+				return true
+			}
+			c := rest[len(rest)-1]
+			rest = rest[:len(rest)-1]
+			stack = append(stack, item{doc: c.doc, flat: c.flat, free: c.free, rest: true})
+			continue
+		}
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch d := it.doc.(type) {
+		case docText:
+			s, broken := firstLine(string(d))
+			width -= utf8.RuneCountInString(s)
+			if broken {
+				return width >= 0
+			}
+		case docVerbatim:
+			s, broken := firstLine(string(d))
+			width -= utf8.RuneCountInString(s)
+			if broken {
+				return width >= 0
+			}
+		case docComment:
+			width -= utf8.RuneCountInString(string(d))
+		case docLine:
+			if !it.flat || d.hard {
+				return true
+			}
+			width -= utf8.RuneCountInString(d.flat)
+		case docWrap:
+			// Any operator may be wrapped in the width and
+			// canonical layouts, which fits is used with.
+			if it.rest {
+				return true
+			}
+			if d.comment != "" {
+				width -= utf8.RuneCountInString(d.op+d.comment) + 1
+				return width >= 0
+			}
+			width -= utf8.RuneCountInString(d.op) + 2
+		case docIf:
+			alt := d.broken
+			if it.flat {
+				alt = d.flat
+			}
+			if alt != nil {
+				stack = append(stack, item{doc: alt, flat: it.flat, rest: it.rest})
+			}
+		case *docGroup:
+			flat := it.flat && (d.nest || !d.must(m) && !(it.free && d.tail))
+			free := d == g && d.chain
+			for i := len(d.docs) - 1; i >= 0; i-- {
+				stack = append(stack, item{doc: d.docs[i], flat: flat, free: free, rest: it.rest})
+			}
+		}
+	}
+	return false
+}
+
+// operandFits returns whether the operand following a binary operator, which
+// is the text in cmds up to the next binary operator or line break with the
+// groups in it flat unless they must be broken, fits in width.
+func (r *renderer) operandFits(width int, cmds []cmd) bool {
+	type item struct {
+		doc  doc
+		flat bool
+	}
+	m := r.options.layout
+	var stack []item
+	for width >= 0 {
+		if len(stack) == 0 {
+			if len(cmds) == 0 {
+				return true
+			}
+			c := cmds[len(cmds)-1]
+			cmds = cmds[:len(cmds)-1]
+			stack = append(stack, item{doc: c.doc, flat: c.flat})
+			continue
+		}
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch d := it.doc.(type) {
+		case docText:
+			s, broken := firstLine(string(d))
+			width -= utf8.RuneCountInString(s)
+			if broken {
+				return width >= 0
+			}
+		case docVerbatim:
+			s, broken := firstLine(string(d))
+			width -= utf8.RuneCountInString(s)
+			if broken {
+				return width >= 0
+			}
+		case docComment:
+			width -= utf8.RuneCountInString(string(d))
+		case docLine:
+			if !it.flat || d.hard {
+				return true
+			}
+			width -= utf8.RuneCountInString(d.flat)
+		case docWrap:
+			return true
+		case docIf:
+			alt := d.broken
+			if it.flat {
+				alt = d.flat
+			}
+			if alt != nil {
+				stack = append(stack, item{doc: alt, flat: it.flat})
+			}
+		case *docGroup:
+			flat := d.nest && it.flat || !d.nest && !d.must(m)
+			for i := len(d.docs) - 1; i >= 0; i-- {
+				stack = append(stack, item{doc: d.docs[i], flat: flat})
+			}
+		}
+	}
+	return false
+}
+
+// comment writes the trailing comment c, if any, recording it for
+// alignment.
+func (r *renderer) comment(c string) {
+	if c == "" {
+		return
+	}
+	r.text(c)
+	if r.align != nil && r.err == nil {
+		r.align.mark(len(c))
+	}
+}
+
+// firstLine returns the text of s up to its first newline, and whether
+// there is one.
+func firstLine(s string) (string, bool) {
+	i := strings.IndexByte(s, '\n')
+	if i < 0 {
+		return s, false
+	}
+	return s[:i], true
+}
+
+// text writes s.
+func (r *renderer) text(s string) {
+	if r.err != nil {
+		return
+	}
+	_, r.err = r.dst.WriteString(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		r.col = utf8.RuneCountInString(s[i+1:])
+	} else {
+		r.col += utf8.RuneCountInString(s)
+	}
+}
+
+// newLine starts a new line indented by indent levels.
+func (r *renderer) newLine(indent int) {
+	if r.err != nil || !r.options.pretty {
+		return
+	}
+	r.lastWrappedIndex = r.dst.Len()
+	_, r.err = r.dst.WriteNewLine(indent)
+	r.col = indent * utf8.RuneCountInString(r.options.indent)
+}
+
+// wrap writes the binary operator of d, with a line break before or after
+// it when the operator is configured for wrapping and the line has reached
+// the wrap column or d holds a comment, which is written before the break. With the width and canonical layouts, the line is also
+// broken at any binary operator when the operand following it in the cmds
+// to be rendered would extend beyond the wrap column.
+func (r *renderer) wrap(d docWrap, level int, cmds []cmd) {
+	_, wrapOperatorExists := r.options.operatorsToWrapOn[d.fun]
+	lineLength := r.dst.Len() - r.lastWrappedIndex + len(d.fun)
+
+	wrap := d.comment != "" || wrapOperatorExists && lineLength >= r.options.wrapOnColumn
+	if !wrap && r.options.pretty && r.options.layout != SourceLayout {
+		wrap = !r.operandFits(r.options.wrapOnColumn-r.col-len(d.op)-2, cmds)
+	}
+	if wrap {
+		r.lastWrappedIndex = r.dst.Len()
+		// wrapAfterColumnLimit flag dictates whether the newline is placed
+		// before or after the operator
+		if r.options.wrapAfterColumnLimit {
+			// Input: a && b
+			// Output: a &&\nb
+			r.text(" ")
+			r.text(d.op)
+			r.comment(d.comment)
+			if r.options.pretty {
+				r.newLine(d.indent + level)
+			} else {
+				r.text("\n")
+			}
+		} else {
+			// Input: a && b
+			// Output: a\n&& b
+			r.comment(d.comment)
+			if r.options.pretty {
+				r.newLine(d.indent + level)
+			} else {
+				r.text("\n")
+			}
+			r.text(d.op)
+			r.text(" ")
+		}
+		return
+	}
+	r.text(" ")
+	r.text(d.op)
+	r.text(" ")
+}
@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+)
+
+// ErrorKind is the category of an Error.
+type ErrorKind int
+
+const (
+	ParseError       ErrorKind = iota + 1 // the program could not be parsed
+	CheckError                            // the program failed type-checking
+	UnsupportedError                      // the program holds a construct that cannot be formatted
+	IOError                               // the program could not be read or the result written
+	TemplateError                         // the template holding the program could not be parsed
+	CommentError                          // a comment could not be placed in the formatted program
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ParseError:
+		return "parse"
+	case CheckError:
+		return "type-check"
+	case UnsupportedError:
+		return "unsupported"
+	case IOError:
+		return "I/O"
+	case TemplateError:
+		return "template"
+	case CommentError:
+		return "comment"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// Error is an error found while formatting a CEL program.
+type Error struct {
+	Kind ErrorKind
+
+	// File is the name of the input holding the program, if known.
+	// It is not set by this package.
+	File string
+
+	// Line and Column are the 1-based position of the error in the
+	// input, or zero if it is not known. Columns count runes.
+	Line, Column int
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	var buf strings.Builder
+	if e.File != "" {
+		buf.WriteString(e.File)
+		buf.WriteByte(':')
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, "%d:", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&buf, "%d:", e.Column)
+		}
+	}
+	if buf.Len() != 0 {
+		buf.WriteByte(' ')
+	}
+	switch e.Kind {
+	case ParseError:
+		buf.WriteString("failed to parse program: ")
+	case CheckError:
+		buf.WriteString("failed to check program: ")
+	case TemplateError:
+		buf.WriteString("failed to parse template: ")
+	}
+	buf.WriteString(e.Err.Error())
+	return buf.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// issuesError returns an *Error of the given kind for each issue in iss,
+// joined if there is more than one.
+func issuesError(kind ErrorKind, iss *cel.Issues) error {
+	var errs []error
+	for _, e := range iss.Errors() {
+		errs = append(errs, &Error{
+			Kind:   kind,
+			Line:   e.Location.Line(),
+			Column: e.Location.Column() + 1,
+			Err:    errors.New(e.Message),
+		})
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// unsupported returns an UnsupportedError at the position of expr.
+func (un *formatter) unsupported(expr ast.Expr, format string, args ...any) error {
+	err := &Error{Kind: UnsupportedError, Err: fmt.Errorf(format, args...)}
+	if expr != nil {
+		loc := un.info.GetStartLocation(expr.ID())
+		if loc.Line() > 0 {
+			err.Line = loc.Line()
+			err.Column = loc.Column() + 1
+		}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/parser"
+)
+
+func TestFormatErrors(t *testing.T) {
+	t.Run("unsupported", func(t *testing.T) {
+		src := common.NewTextSource("\n  x")
+		info := ast.NewSourceInfo(src)
+		info.SetOffsetRange(1, ast.OffsetRange{Start: 3, Stop: 4})
+		a := ast.NewAST(ast.NewExprFactory().NewUnspecifiedExpr(1), info)
+		err := Format(io.Discard, a, src)
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("unexpected error type: %#v", err)
+		}
+		want := Error{Kind: UnsupportedError, Line: 2, Column: 3}
+		if e.Kind != want.Kind || e.Line != want.Line || e.Column != want.Column {
+			t.Errorf("unexpected error: got:%+v want:%+v", *e, want)
+		}
+		if got, want := e.Error(), "2:3: unsupported expression: 0"; got != want {
+			t.Errorf("unexpected message: got:%q want:%q", got, want)
+		}
+	})
+	t.Run("io", func(t *testing.T) {
+		p, err := parser.NewParser(parser.Macros(parser.AllMacros...), parser.PopulateMacroCalls(true))
+		if err != nil {
+			t.Fatalf("failed to create parser: %v", err)
+		}
+		src := common.NewTextSource(`[1, 2]`)
+		a, iss := p.Parse(src)
+		if len(iss.GetErrors()) != 0 {
+			t.Fatalf("unexpected parse error: %v", iss.ToDisplayString())
+		}
+		err = Format(failWriter{}, a, src)
+		var e *Error
+		if !errors.As(err, &e) || e.Kind != IOError || !errors.Is(err, errWrite) {
+			t.Errorf("unexpected error: %#v", err)
+		}
+		e.File = "src.cel"
+		if got, want := e.Error(), "src.cel: write failed"; got != want {
+			t.Errorf("unexpected message: got:%q want:%q", got, want)
+		}
+	})
+}
+
+var errWrite = errors.New("write failed")
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errWrite }
@@ -17,7 +17,6 @@ package celfmt
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"slices"
@@ -43,50 +42,115 @@ import (
 // - Spacing around punctuation marks may be lost.
 // - Parentheses will only be applied when they affect operator precedence.
 //
+// When pretty printing, expressions between "// celfmt:off" and "// celfmt:on" comments, and the
+// expression following a "// celfmt:ignore" comment, are copied from the source verbatim.
+//
 // This function optionally takes in one or more UnparserOption to alter the formatting behavior, such as
 // performing word wrapping on expressions.
 func Format(dst io.Writer, ast *ast.AST, src common.Source, opts ...FormatOption) error {
-	unparserOpts := &unparserOption{
-		wrapOnColumn:         defaultWrapOnColumn,
-		wrapAfterColumnLimit: defaultWrapAfterColumnLimit,
-		operatorsToWrapOn:    defaultOperatorsToWrapOn,
-		indent:               defaultIndentString,
+	unparserOpts, err := applyOptions(opts)
+	if err != nil {
+		return err
+	}
+	un := newFormatter(dst, ast, src, unparserOpts)
+	err = un.visit(ast.Expr(), false)
+	if err == nil && unparserOpts.pretty {
+		un.writeTrailingComments()
+	}
+	un.err = un.render()
+	if un.err != nil {
+		// The error is from writing to dst.
+		return &Error{Kind: IOError, Err: un.err}
+	}
+	if err != nil || !unparserOpts.pretty {
+		return err
+	}
+	dropped := un.droppedComments()
+	if unparserOpts.droppedComments != nil {
+		*unparserOpts.droppedComments = dropped
+	}
+	if unparserOpts.strictComments && len(dropped) != 0 {
+		return droppedCommentsError(dropped)
 	}
+	return nil
+}
 
-	var err error
-	for _, opt := range opts {
-		unparserOpts, err = opt(unparserOpts)
-		if err != nil {
-			return err
-		}
+// newFormatter returns a formatter writing the expression in a to dst.
+func newFormatter(dst io.Writer, a *ast.AST, src common.Source, opts *unparserOption) *formatter {
+	if !opts.pretty && opts.layout != SourceLayout {
+		// Without pretty printing there are no line breaks to
+		// choose between.
+		o := *opts
+		o.layout = SourceLayout
+		opts = &o
 	}
-	expr := ast.Expr()
 	un := &formatter{
-		dst:      lenWriter{w: dst, indent: unparserOpts.indent},
+		dst:      lenWriter{w: dst, indent: opts.indent},
 		src:      src,
-		info:     ast.SourceInfo(),
-		options:  unparserOpts,
+		info:     a.SourceInfo(),
+		root:     a.Expr().ID(),
+		options:  opts,
+		text:     lexSource(src.Content()),
 		comments: make(map[location]int64),
+		cmap:     opts.comments,
+		emitted:  make(map[commentKey]bool),
+		docs:     []*docGroup{{broken: true}},
 	}
-	err = un.visit(expr, false)
-	if err != nil {
-		return err
+	if opts.pretty {
+		un.extents = newExtents(a, un.text)
+		un.protect = newProtector(a, un.text)
 	}
-	return nil
+	return un
 }
 
 // formatter visits an expression to reconstruct a human-readable string from an AST.
 type formatter struct {
-	dst              lenWriter
-	src              common.Source
-	info             *ast.SourceInfo
-	options          *unparserOption
-	lastWrappedIndex int
-
+	dst     lenWriter
+	src     common.Source
+	info    *ast.SourceInfo
+	root    int64 // ID of the root expression
+	options *unparserOption
+
+	// docs holds the open groups of the document being built, with
+	// the root group first.
+	docs   []*docGroup
 	indent int
 
+	// chained is the member call whose target is being visited as
+	// part of an enclosing chain of member calls, and flatChain is
+	// whether that chain is written on one line by the source layout.
+	chained   ast.Expr
+	flatChain bool
+
+	// between is whether the next text written starts an element of
+	// a list, map or message, or an argument of a call. A blank line
+	// may only be written there.
+	between bool
+
+	// text is the lexical structure of the source and comments
+	// holds the comments and blank lines that have been claimed by
+	// an expression, keyed by their position in the source.
+	text     *sourceText
 	comments map[location]int64
 
+	// cmap, if not nil, holds the comments to write in place of
+	// those found in the source, and emitted records the comments
+	// in cmap that have been written.
+	cmap    CommentMap
+	emitted map[commentKey]bool
+
+	// protect, if not nil, finds the parts of the program that
+	// directives protect from formatting.
+	protect *protector
+
+	// extents, if not nil, finds the extents of the parts of the
+	// program in the source.
+	extents *extents
+
+	// record, if not nil, receives the comments claimed by each
+	// expression.
+	record CommentMap
+
 	err error
 }
 
@@ -130,40 +194,74 @@ type location struct {
 	line, col int
 }
 
-func (un *formatter) WriteString(s string) (int, error) {
-	if un.err != nil {
-		return 0, un.err
+// WriteString writes s to the document.
+func (un *formatter) WriteString(s string) {
+	un.add(docText(s))
+	if s != "" {
+		un.between = false
+	}
+	if strings.Contains(s, "\n") {
+		un.cur().hard = true
 	}
-	var n int
-	n, un.err = un.dst.WriteString(s)
-	return n, un.err
 }
 
-func (un *formatter) WriteNewLine() (int, error) {
-	if un.err != nil {
-		return 0, un.err
-	}
+// WriteNewLine writes a hard line break at the current indentation to the
+// document.
+func (un *formatter) WriteNewLine() {
 	if !un.options.pretty {
-		return 0, nil
+		return
 	}
-	un.lastWrappedIndex = un.dst.Len()
-	var n int
-	n, un.err = un.dst.WriteNewLine(un.indent)
-	return n, un.err
+	un.add(docLine{indent: un.indent, hard: true})
+	un.cur().hard = true
 }
 
+// render writes the document to dst.
+func (un *formatter) render() error {
+	r := renderer{dst: &un.dst, options: un.options}
+	if !un.options.pretty || !un.options.alignComments {
+		return r.render(un.docs[0])
+	}
+	dst := un.dst.w
+	r.align = &commentAligner{indent: un.options.indent}
+	un.dst.w = r.align
+	err := r.render(un.docs[0])
+	if err != nil {
+		return err
+	}
+	_, err = r.align.WriteTo(dst)
+	return err
+}
+
+// CommentBlock returns the lines of the comments preceding the expression
+// with the given ID, with blank lines retained as empty strings. Each
+// comment is only returned once.
 func (un *formatter) CommentBlock(id int64) []string {
+	// ¯\_(ツ)_/¯ The AST's position information is weaker than is ideal.
+	return un.commentBlock(id, un.info.GetStartLocation(id).Line(), true)
+}
+
+// commentBlock returns the lines of the comments preceding the given line
+// for the expression with the given ID. If first is true, the line itself
+// is skipped if it holds code.
+func (un *formatter) commentBlock(id int64, line int, first bool) []string {
 	if !un.options.pretty {
 		return nil
 	}
-	var comments []string
-	start := un.info.GetStartLocation(id)
-	first := true // ¯\_(ツ)_/¯ The AST's position information is weaker than is ideal.
+	if un.cmap != nil {
+		key := commentKey{id, LeadingComment}
+		if un.emitted[key] {
+			return nil
+		}
+		un.emitted[key] = true
+		return commentLines(un.cmap[id].Leading)
+	}
+	var (
+		comments []Comment
+		claimed  []location
+	)
 	wasBlank := false
-	for line := start.Line(); line > 0; line-- {
-		text, ok := un.src.Snippet(line)
-		comment := strings.TrimSpace(text)
-		if !ok || (comment != "" && !strings.HasPrefix(comment, "//")) {
+	for ; line > 0; line-- {
+		if un.text.lineKind(line) == codeLine {
 			if first {
 				first = false
 				continue
@@ -171,65 +269,129 @@ func (un *formatter) CommentBlock(id int64) []string {
 			break
 		}
 		first = false
-		loc := location{line, strings.Index(text, comment)}
+		if un.ignoring(line) {
+			break
+		}
+		loc, comment := un.lineComment(line)
 		if cid, ok := un.comments[loc]; ok {
 			if cid != id {
+				// Release the lines claimed so far so that the
+				// comments are not considered to have been written.
+				for _, loc := range claimed {
+					delete(un.comments, loc)
+				}
 				return nil
 			}
 			break
 		}
 		un.comments[loc] = id
-		if comment != "" {
-			// Remove comment prefix and any leading non-tab spaces.
-			comment = strings.TrimPrefix(comment, "//")
-			idx := strings.IndexFunc(comment, func(r rune) bool {
-				return r == '\t' || !unicode.IsSpace(r)
-			})
-			if idx >= 0 {
-				comment = comment[idx:]
-			}
-			// Remove all trailing white space.
-			comment = strings.TrimRight(comment, " \t\n\v\f\r\u0085\u00a0")
-			// Format comment with a leading space between text and mark.
-			if comment == "" {
-				comment = "//"
-			} else {
-				comment = "// " + comment
-			}
+		claimed = append(claimed, loc)
+		if comment.Text != "" {
 			comments = append(comments, comment)
 			wasBlank = false
 		} else if !wasBlank {
-			comments = append(comments, "")
+			comments = append(comments, comment)
 			wasBlank = true
 		}
 	}
 	slices.Reverse(comments)
-	return comments
+	un.recordComments(id, LeadingComment, comments...)
+	return commentLines(comments)
+}
+
+// lineComment returns the position of the comment on a line that holds no
+// code and the comment, or the position of the start of the line and an
+// empty comment if the line is blank.
+func (un *formatter) lineComment(line int) (location, Comment) {
+	c, ok := un.text.comment(line)
+	if !ok {
+		return location{line, 0}, Comment{Line: line}
+	}
+	return location{line, c.col}, c.comment()
 }
 
+// ignoring returns whether the comment on a line is a celfmt:ignore
+// directive that is written with the unit it protects.
+func (un *formatter) ignoring(line int) bool {
+	c, ok := un.text.comment(line)
+	return ok && un.protect.ignoring(c.offset)
+}
+
+// Comment returns the comment following the expression with the given ID
+// on the line on which the expression ends, if it has not been claimed.
 func (un *formatter) Comment(id int64) string {
 	if !un.options.pretty {
 		return ""
 	}
-	start := un.info.GetStartLocation(id)
-	text, ok := un.src.Snippet(start.Line())
+	if un.cmap != nil {
+		key := commentKey{id, TrailingComment}
+		if un.emitted[key] {
+			return ""
+		}
+		un.emitted[key] = true
+		var buf strings.Builder
+		for _, c := range un.cmap[id].Trailing {
+			buf.WriteString(" // " + strings.TrimSpace(strings.TrimPrefix(c.Text, "//")))
+		}
+		return buf.String()
+	}
+	stop := un.info.GetStopLocation(id)
+	c, ok := un.text.comment(stop.Line())
+	if !ok || c.runeCol < stop.Column() || un.protect.ignoring(c.offset) {
+		return ""
+	}
+	return un.claimComment(id, c)
+}
+
+// unitComment returns the comment following the unit u on the line on
+// which it ends in the source, if it has not been claimed. Only the
+// separator sep, such as a comma or the operator of a binary expression,
+// may come between the unit and the comment, preceded by a closing
+// parenthesis if nested is true. The comment is attached to the last
+// expression of the unit.
+func (un *formatter) unitComment(u unit, nested bool, sep string) string {
+	last := u.exprs[len(u.exprs)-1]
+	id := last.ID()
+	if un.cmap != nil || un.extents == nil {
+		return un.Comment(id)
+	}
+	s, ok := un.extents.extent(u)
 	if !ok {
+		// The comment may still follow the last child of the unit.
+		s, ok = un.extents.extent(unit{exprs: []ast.Expr{un.lastChild(last)}})
+		if !ok {
+			return ""
+		}
+	}
+	c, ok := un.text.comment(un.text.line(s.end))
+	if !ok || c.offset < s.end || un.protect.ignoring(c.offset) {
 		return ""
 	}
-	stop := un.info.GetStopLocation(id)
-	if stop.Column() <= len(text) {
-		text = text[stop.Column():]
+	between := strings.TrimSpace(un.text.src[s.end:c.offset])
+	if nested {
+		between, ok = strings.CutPrefix(between, ")")
+		if !ok {
+			return ""
+		}
+		between = strings.TrimSpace(between)
 	}
-	idx := strings.LastIndex(text, "//")
-	if idx < 0 {
+	if between != "" && between != sep {
 		return ""
 	}
-	loc := location{start.Line(), stop.Column() + idx}
+	return un.claimComment(id, c)
+}
+
+// claimComment claims the comment c as the trailing comment of the
+// expression with the given ID and returns it, or returns the empty string
+// if it has been claimed.
+func (un *formatter) claimComment(id int64, c sourceComment) string {
+	loc := location{c.line, c.col}
 	if _, ok := un.comments[loc]; ok {
 		return ""
 	}
 	un.comments[loc] = id
-	return " // " + strings.TrimSpace(strings.TrimPrefix(text[idx:], "//"))
+	un.recordComments(id, TrailingComment, c.comment())
+	return " // " + strings.TrimSpace(strings.TrimPrefix(c.text, "//"))
 }
 
 func (un *formatter) visit(expr ast.Expr, macro bool) error {
@@ -237,12 +399,16 @@ func (un *formatter) visit(expr ast.Expr, macro bool) error {
 		return un.err
 	}
 	if expr == nil {
-		return errors.New("unsupported expression")
+		return un.unsupported(nil, "unsupported expression")
 	}
 
-	for _, c := range un.CommentBlock(expr.ID()) {
-		un.WriteString(c)
-		un.WriteNewLine()
+	if un.writeProtected([]unit{{exprs: []ast.Expr{expr}}}, 0) != 0 {
+		return nil
+	}
+	// The comments preceding member calls are written by
+	// visitCallFunc, which places those of chained calls.
+	if !un.isMemberCall(expr) {
+		un.writeCommentBlock(expr.ID())
 	}
 
 	visited, err := un.visitMaybeMacroCall(expr)
@@ -265,7 +431,7 @@ func (un *formatter) visit(expr ast.Expr, macro bool) error {
 	case ast.StructKind:
 		return un.visitStructMsg(expr)
 	default:
-		return fmt.Errorf("unsupported expression: %v", expr.Kind())
+		return un.unsupported(expr, "unsupported expression: %v", expr.Kind())
 	}
 }
 
@@ -331,10 +497,13 @@ func (un *formatter) visitCallBinary(expr ast.Expr) error {
 	}
 	unmangled, found := operators.FindReverseBinaryOperator(fun)
 	if !found {
-		return fmt.Errorf("cannot unmangle operator: %s", fun)
+		return un.unsupported(expr, "cannot unmangle operator: %s", fun)
 	}
 
-	un.writeOperatorWithWrapping(fun, unmangled)
+	// A comment following the operator or the lhs operand ends
+	// the line after the operator.
+	comment := un.unitComment(unit{exprs: []ast.Expr{lhs}}, lhsParen, unmangled)
+	un.writeOperatorWithWrapping(fun, unmangled, comment)
 	return un.visitMaybeNested(rhs, rhsParen)
 }
 
@@ -348,40 +517,14 @@ func (un *formatter) visitCallConditional(expr ast.Expr) error {
 	if err != nil {
 		return err
 	}
-	if un.isMultiline(expr) {
-		un.WriteString(" ?")
-		un.indent++
-		un.WriteString(un.Comment(args[0].ID()))
-		un.WriteNewLine()
-
-		// add parens if operand is a conditional itself.
-		nested = isSamePrecedence(operators.Conditional, args[1]) ||
-			isComplexOperator(args[1])
-		err = un.visitMaybeNested(args[1], nested)
-		if err != nil {
-			return err
-		}
-
-		un.indent--
-		un.WriteString(un.Comment(args[1].ID()))
-		un.WriteNewLine()
-		un.WriteString(":")
-		cuddle := args[2].Kind() == ast.CallKind && args[2].AsCall().FunctionName() == operators.Conditional &&
-			!un.hasCommentsForExpr(args[2].ID())
-		if cuddle {
-			un.WriteString(" ")
-		} else {
-			un.indent++
-			un.WriteNewLine()
-		}
-
-		err = un.visit(args[2], false)
-		if !cuddle {
-			un.indent--
-		}
-		return err
+	multiline := un.isMultiline(expr)
+	un.openGroup(multiline)
+	un.WriteIf(docText(" ?"), docWrap{fun: operators.Conditional, op: "?", indent: un.indent})
+	un.openNest()
+	if multiline {
+		un.writeComment(args[0].ID())
 	}
-	un.writeOperatorWithWrapping(operators.Conditional, "?")
+	un.WriteLine("")
 
 	// add parens if operand is a conditional itself.
 	nested = isSamePrecedence(operators.Conditional, args[1]) ||
@@ -391,24 +534,107 @@ func (un *formatter) visitCallConditional(expr ast.Expr) error {
 		return err
 	}
 
-	un.WriteString(" : ")
-	// add parens if operand is a conditional itself.
+	un.closeGroup()
+	if multiline {
+		un.writeComment(args[1].ID())
+	}
+	un.WriteLine(" ")
+	un.WriteString(":")
+	// A conditional else branch is cuddled when broken, and the
+	// else branch is only parenthesized when flat.
+	cuddle := args[2].Kind() == ast.CallKind && args[2].AsCall().FunctionName() == operators.Conditional &&
+		!un.hasCommentsForExpr(args[2].ID())
+	if cuddle {
+		un.WriteString(" ")
+	} else {
+		un.openNest()
+		un.WriteLine(" ")
+	}
 	nested = isSamePrecedence(operators.Conditional, args[2]) ||
 		isComplexOperator(args[2])
-
-	return un.visitMaybeNested(args[2], nested)
+	if nested {
+		un.WriteIf(nil, docText("("))
+	}
+	err = un.visit(args[2], false)
+	if err != nil {
+		return err
+	}
+	if nested {
+		un.WriteIf(nil, docText(")"))
+	}
+	if !cuddle {
+		un.closeGroup()
+	}
+	un.closeGroup()
+	return nil
 }
 
 func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 	c := expr.AsCall()
 	fun := c.FunctionName()
 	args := c.Args()
+	// tail is whether the call is the last call of a chain.
+	var tail bool
 	if c.IsMemberFunction() {
+		id := expr.ID()
+		if macro {
+			id = un.macroID(expr)
+		}
+		// Chains of member calls are only broken by width, and
+		// the group of a chain is opened by its last call.
+		chained := un.chained == expr
+		if !chained {
+			n, broken := un.chainLength(expr, macro)
+			commented := un.commentedChain(expr, id)
+			switch {
+			case n == 1 && !commented:
+				un.writeCallComments(expr, id)
+			case un.options.layout == SourceLayout && !commented:
+				// The chain is not broken, so the comments
+				// preceding its calls precede it, in order.
+				un.flatChain = true
+				un.writeCommentBlock(un.chainRoot(expr).ID())
+				var calls []ast.Expr
+				var ids []int64
+				for call, id := expr, id; call != nil; call, id = un.chainCall(call.AsCall().Target()) {
+					calls = append(calls, call)
+					ids = append(ids, id)
+				}
+				for i := len(calls) - 1; i >= 0; i-- {
+					un.writeCallComments(calls[i], ids[i])
+				}
+			default:
+				// The source layout breaks a chain when the
+				// line of the target of a call ends with a
+				// comment.
+				chained, tail = true, true
+				un.flatChain = false
+				// The comments preceding the chain are
+				// written before its group so that they
+				// neither break nor indent it.
+				un.writeCommentBlock(un.chainRoot(expr).ID())
+				g := un.openGroup(broken)
+				g.chain = true
+				defer un.closeGroup()
+			}
+		}
+		un.chained, _ = un.chainCall(c.Target())
 		nested := isBinaryOrTernaryOperator(c.Target())
 		err := un.visitMaybeNested(c.Target(), nested)
 		if err != nil {
 			return err
 		}
+		if chained && !un.flatChain {
+			// A comment ending the line of the target in the
+			// source breaks the chain before the call, and the
+			// comments preceding the call are written on the
+			// lines before it rather than before the chain.
+			if un.brokenBefore(id) {
+				un.writeTrailing(un.unitComment(unit{exprs: []ast.Expr{c.Target()}}, nested, ""))
+			}
+			un.WriteLine("")
+			un.writeCallComments(expr, id)
+		}
 		un.WriteString(".")
 	}
 	if len(args) == 0 {
@@ -419,16 +645,7 @@ func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 	case macro:
 		un.WriteString(fun + "(")
 
-		// get AST ID for macro. this is not stored in the
-		// expression, so we need to do a scan of all macros.
-		var id int64
-		for candid, cand := range un.info.MacroCalls() {
-			if expr == cand {
-				id = candid
-				break
-			}
-		}
-		base := un.info.GetStartLocation(id).Line()
+		base := un.info.GetStartLocation(un.macroID(expr)).Line()
 		var (
 			last    int
 			wasTern bool
@@ -449,6 +666,16 @@ func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 			}
 			last = i + 1
 		}
+		if un.options.layout != SourceLayout {
+			if un.options.layout == CanonicalLayout || last == len(args) && !wasTern || last == len(args)-1 && un.hugs(base, args[last]) {
+				return un.visitMacroArgs(args, tail)
+			}
+			// The arguments are laid out as they are in the
+			// source, in a group so that they may be the tail of
+			// a chain.
+			un.openGroup(true).tail = tail
+			defer un.closeGroup()
+		}
 
 		// write single-line section.
 		for i, arg := range args[:last] {
@@ -462,6 +689,7 @@ func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 		}
 		if last != 0 && last < len(args) {
 			un.WriteString(",")
+			un.writeUnitComment(unit{exprs: []ast.Expr{args[last-1]}})
 		}
 		if last == len(args) {
 			if wasTern {
@@ -475,6 +703,7 @@ func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 		un.indent++
 		for i, arg := range args[last:] {
 			un.WriteNewLine()
+			un.between = true
 			err := un.visit(arg, false)
 			if err != nil {
 				return err
@@ -482,15 +711,33 @@ func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 			if i < len(args[last:])-1 {
 				un.WriteString(",")
 			}
+			un.writeUnitComment(unit{exprs: []ast.Expr{arg}})
 		}
 		un.indent--
 		un.WriteNewLine()
 		un.WriteString(")")
-	case un.isMultiline(expr):
+	case un.options.layout != SourceLayout && len(args) == 1 && un.hugs(un.info.GetStartLocation(expr.ID()).Line(), args[0]):
+		// A sole list, map or message argument is broken rather
+		// than the call.
 		un.WriteString(fun + "(")
-		un.indent++
+		un.openGroup(false).tail = tail
+		err := un.visit(args[0], false)
+		if err != nil {
+			return err
+		}
+		un.closeGroup()
+		un.WriteString(")")
+	default:
+		un.WriteString(fun + "(")
+		un.openGroup(un.isMultiline(expr)).tail = tail
+		un.openNest()
 		for i, arg := range args {
-			un.WriteNewLine()
+			if i == 0 {
+				un.WriteLine("")
+			} else {
+				un.WriteLine(" ")
+			}
+			un.between = true
 			err := un.visit(arg, false)
 			if err != nil {
 				return err
@@ -498,26 +745,220 @@ func (un *formatter) visitCallFunc(expr ast.Expr, macro bool) error {
 			if i < len(args)-1 {
 				un.WriteString(",")
 			}
+			un.writeUnitComment(unit{exprs: []ast.Expr{arg}})
 		}
-		un.indent--
-		un.WriteNewLine()
+		un.closeGroup()
+		un.WriteLine("")
+		un.closeGroup()
 		un.WriteString(")")
-	default:
-		un.WriteString(fun + "(")
+	}
+	return nil
+}
+
+// visitMacroArgs writes the arguments of a macro call that is on a single
+// line of the source as a group, which is the tail of a chain if tail is
+// true. When the group is broken, the leading identifiers, which name the
+// macro's variables, remain on the line of the call and the remaining
+// arguments are each on a line of their own.
+func (un *formatter) visitMacroArgs(args []ast.Expr, tail bool) error {
+	vars := 0
+	for vars < len(args)-1 && args[vars].Kind() == ast.IdentKind {
+		vars++
+	}
+	// A list, map or message following the variables is broken
+	// rather than the call.
+	if vars == len(args)-1 && un.huggable(args[vars]) {
+		vars++
+	}
+	un.openGroup(false).tail = tail
+	if vars == len(args) {
 		for i, arg := range args {
+			if i != 0 {
+				un.WriteString(", ")
+			}
 			err := un.visit(arg, false)
 			if err != nil {
 				return err
 			}
-			if i < len(args)-1 {
-				un.WriteString(", ")
-			}
 		}
+		un.closeGroup()
 		un.WriteString(")")
+		return nil
+	}
+	un.openNest()
+	for i, arg := range args {
+		switch {
+		case i == 0 && vars == 0:
+			un.WriteLine("")
+			un.between = true
+		case i == 0:
+		case i < vars:
+			un.WriteString(", ")
+		default:
+			un.WriteString(",")
+			un.writeUnitComment(unit{exprs: []ast.Expr{args[i-1]}})
+			un.WriteLine(" ")
+			un.between = true
+		}
+		err := un.visit(arg, false)
+		if err != nil {
+			return err
+		}
 	}
+	un.writeUnitComment(unit{exprs: []ast.Expr{args[len(args)-1]}})
+	un.closeGroup()
+	un.WriteLine("")
+	un.closeGroup()
+	un.WriteString(")")
 	return nil
 }
 
+// hugs returns whether the argument expr of a call with its "(" on the
+// given line is huggable and starts on that line in the source. The line
+// is disregarded in the CanonicalLayout mode.
+func (un *formatter) hugs(line int, expr ast.Expr) bool {
+	if un.options.layout == CanonicalLayout {
+		return un.huggable(expr)
+	}
+	return un.huggable(expr) && un.info.GetStartLocation(expr.ID()).Line() == line
+}
+
+// huggable returns whether expr is a list, map or message, which may be
+// broken over lines while the call it is the argument of is not.
+func (un *formatter) huggable(expr ast.Expr) bool {
+	if _, ok := un.info.GetMacroCall(expr.ID()); ok {
+		return false
+	}
+	switch expr.Kind() {
+	case ast.ListKind, ast.MapKind, ast.StructKind:
+		return true
+	default:
+		return false
+	}
+}
+
+// macroID returns the ID of the expression that the macro call expr was
+// expanded to.
+func (un *formatter) macroID(expr ast.Expr) int64 {
+	// get AST ID for macro. this is not stored in the
+	// expression, so we need to do a scan of all macros.
+	for id, cand := range un.info.MacroCalls() {
+		if expr == cand {
+			return id
+		}
+	}
+	return 0
+}
+
+// chainLength returns the number of member calls in the chain ending with
+// the member call expr, and whether a line of the source ends before any of
+// them.
+func (un *formatter) chainLength(expr ast.Expr, macro bool) (int, bool) {
+	id := expr.ID()
+	if macro {
+		id = un.macroID(expr)
+	}
+	var (
+		n      int
+		broken bool
+	)
+	for call := expr; call != nil; call, id = un.chainCall(call.AsCall().Target()) {
+		n++
+		broken = broken || un.brokenBefore(id)
+	}
+	return n, broken
+}
+
+// brokenBefore returns whether a line of the source ends between the member
+// call with the given ID and its target.
+func (un *formatter) brokenBefore(id int64) bool {
+	loc := un.info.GetStartLocation(id)
+	k, ok := un.text.tokenAt(un.text.locate(loc.Line(), loc.Column()))
+	// The call is positioned at its "(", which follows the target,
+	// a "." and the function name.
+	if !ok || k < 3 {
+		return false
+	}
+	toks := un.text.tokens
+	return strings.Contains(un.text.src[toks[k-3].end:toks[k].start], "\n")
+}
+
+// commentedChain returns whether a comment ends the line of the target of
+// any call of the chain of member calls ending with the member call expr,
+// which was expanded to the expression with the given ID if it is a macro
+// call.
+func (un *formatter) commentedChain(expr ast.Expr, id int64) bool {
+	for call := expr; call != nil; call, id = un.chainCall(call.AsCall().Target()) {
+		if un.commentedBefore(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// commentedBefore returns whether a comment ends the line of the target of
+// the member call with the given ID in the source.
+func (un *formatter) commentedBefore(id int64) bool {
+	loc := un.info.GetStartLocation(id)
+	k, ok := un.text.tokenAt(un.text.locate(loc.Line(), loc.Column()))
+	if !ok || k < 3 {
+		return false
+	}
+	toks := un.text.tokens
+	c, ok := un.text.comment(un.text.line(toks[k-3].end))
+	return ok && toks[k-3].end <= c.offset && c.offset < toks[k-2].start
+}
+
+// chainRoot returns the expression starting the chain of member calls
+// ending with the member call expr, which is the target of its first call
+// or the operand of the field selections that are that target.
+func (un *formatter) chainRoot(expr ast.Expr) ast.Expr {
+	for {
+		target := expr.AsCall().Target()
+		call, _ := un.chainCall(target)
+		if call == nil {
+			for target.Kind() == ast.SelectKind && !target.AsSelect().IsTestOnly() {
+				target = target.AsSelect().Operand()
+			}
+			return target
+		}
+		expr = call
+	}
+}
+
+// chainCall returns the member call that expr is, or that is reached from
+// expr through field selections, together with the ID of the macro
+// expression the call was expanded to, if it is a macro call. Such a call
+// is part of the same chain of member calls as the call whose target is
+// expr. If there is none, chainCall returns nil.
+func (un *formatter) chainCall(expr ast.Expr) (ast.Expr, int64) {
+	for {
+		id := expr.ID()
+		if call, ok := un.info.GetMacroCall(id); ok {
+			expr = call
+		}
+		switch expr.Kind() {
+		case ast.SelectKind:
+			sel := expr.AsSelect()
+			if sel.IsTestOnly() || isBinaryOrTernaryOperator(sel.Operand()) {
+				return nil, 0
+			}
+			expr = sel.Operand()
+		case ast.CallKind:
+			c := expr.AsCall()
+			if c.IsMemberFunction() {
+				return expr, id
+			}
+			if c.FunctionName() != operators.OptSelect || isBinaryOrTernaryOperator(c.Args()[0]) {
+				return nil, 0
+			}
+			expr = c.Args()[0]
+		default:
+			return nil, 0
+		}
+	}
+}
+
 func (un *formatter) visitCallIndex(expr ast.Expr) error {
 	return un.visitCallIndexInternal(expr, "[")
 }
@@ -549,7 +990,7 @@ func (un *formatter) visitCallUnary(expr ast.Expr) error {
 	args := c.Args()
 	unmangled, found := operators.FindReverse(fun)
 	if !found {
-		return fmt.Errorf("cannot unmangle operator: %s", fun)
+		return un.unsupported(expr, "cannot unmangle operator: %s", fun)
 	}
 	un.WriteString(unmangled)
 	nested := isComplexOperator(args[0])
@@ -609,7 +1050,7 @@ func (un *formatter) visitConst(expr ast.Expr) error {
 		un.WriteString(ui)
 		un.WriteString("u")
 	default:
-		return fmt.Errorf("unsupported constant: %v", expr)
+		return un.unsupported(expr, "unsupported constant: %v", expr)
 	}
 	return nil
 }
@@ -639,14 +1080,24 @@ func (un *formatter) visitList(expr ast.Expr) error {
 		optIndices[int(idx)] = true
 	}
 	un.WriteString("[")
-	if un.isMultiline(expr) {
-		un.indent++
-		for i, elem := range elems {
-			un.WriteNewLine()
+	// Comments and directives are only placed within the list when
+	// it spans lines in the source.
+	multiline := un.isMultiline(expr)
+	units := make([]unit, len(elems))
+	for i, elem := range elems {
+		units[i] = unit{exprs: []ast.Expr{elem}, optional: optIndices[i]}
+	}
+	un.openGroup(multiline)
+	un.openNest()
+	for i := 0; i < len(elems); i++ {
+		un.writeSeparator(i)
+		if n := un.protected(multiline, units, i); n != 0 {
+			i += n - 1
+		} else {
+			elem := elems[i]
 			if optIndices[i] {
-				for _, c := range un.CommentBlock(elem.ID()) {
-					un.WriteString(c)
-					un.WriteNewLine()
+				if multiline {
+					un.writeCommentBlock(elem.ID())
 				}
 				un.WriteString("?")
 			}
@@ -654,29 +1105,19 @@ func (un *formatter) visitList(expr ast.Expr) error {
 			if err != nil {
 				return err
 			}
-			if un.options.alwaysComma || i < len(elems)-1 {
-				un.WriteString(",")
-			}
-			un.WriteString(un.Comment(un.lastChild(elem).ID()))
 		}
-		un.indent--
-		un.WriteNewLine()
-		un.WriteString("]")
-	} else {
-		for i, elem := range elems {
-			if optIndices[i] {
-				un.WriteString("?")
-			}
-			err := un.visit(elem, false)
-			if err != nil {
-				return err
-			}
-			if i < len(elems)-1 {
-				un.WriteString(", ")
-			}
+		un.writeComma(i, len(elems))
+		if multiline {
+			un.writeUnitComment(units[i])
 		}
-		un.WriteString("]")
 	}
+	if multiline && len(units) != 0 {
+		un.writeClosingDirectives(expr, units[len(units)-1])
+	}
+	un.closeGroup()
+	un.WriteLine("")
+	un.closeGroup()
+	un.WriteString("]")
 	return nil
 }
 
@@ -716,54 +1157,49 @@ func (un *formatter) visitStructMsg(expr ast.Expr) error {
 	fields := m.Fields()
 	un.WriteString(m.TypeName())
 	un.WriteString("{")
-	if un.isMultiline(expr) {
-		un.indent++
-		for i, f := range fields {
-			field := f.AsStructField()
+	multiline := un.isMultiline(expr)
+	units := make([]unit, len(fields))
+	for i, f := range fields {
+		units[i] = fieldUnit(f)
+	}
+	un.openGroup(multiline)
+	un.openNest()
+	for i := 0; i < len(fields); i++ {
+		field := fields[i].AsStructField()
+		un.writeSeparator(i)
+		if n := un.protected(multiline, units, i); n != 0 {
+			i += n - 1
+			field = fields[i].AsStructField()
+		} else {
 			f := field.Name()
 			v := field.Value()
-			un.WriteNewLine()
-			if field.IsOptional() {
-				for _, c := range un.CommentBlock(v.ID()) {
-					un.WriteString(c)
-					un.WriteNewLine()
-				}
-				un.WriteString("?")
+			// The comments preceding the value are written
+			// before the field name.
+			if multiline {
+				un.writeCommentBlock(v.ID())
 			}
-			un.WriteString(f)
-			un.WriteString(": ")
-			err := un.visit(v, false)
-			if err != nil {
-				return err
-			}
-			if un.options.alwaysComma || i < len(fields)-1 {
-				un.WriteString(",")
-			}
-			un.WriteString(un.Comment(un.lastChild(field.Value()).ID()))
-		}
-		un.indent--
-		un.WriteNewLine()
-		un.WriteString("}")
-	} else {
-		for i, f := range fields {
-			field := f.AsStructField()
-			f := field.Name()
 			if field.IsOptional() {
 				un.WriteString("?")
 			}
 			un.WriteString(f)
 			un.WriteString(": ")
-			v := field.Value()
 			err := un.visit(v, false)
 			if err != nil {
 				return err
 			}
-			if i < len(fields)-1 {
-				un.WriteString(", ")
-			}
 		}
-		un.WriteString("}")
+		un.writeComma(i, len(fields))
+		if multiline {
+			un.writeUnitComment(units[i])
+		}
+	}
+	if multiline && len(units) != 0 {
+		un.writeClosingDirectives(expr, units[len(units)-1])
 	}
+	un.closeGroup()
+	un.WriteLine("")
+	un.closeGroup()
+	un.WriteString("}")
 	return nil
 }
 
@@ -771,16 +1207,25 @@ func (un *formatter) visitStructMap(expr ast.Expr) error {
 	m := expr.AsMap()
 	entries := m.Entries()
 	un.WriteString("{")
-	if un.isMultiline(expr) {
-		un.indent++
-		for i, e := range entries {
+	multiline := un.isMultiline(expr)
+	units := make([]unit, len(entries))
+	for i, e := range entries {
+		units[i] = mapUnit(e)
+	}
+	un.openGroup(multiline)
+	un.openNest()
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		un.writeSeparator(i)
+		if n := un.protected(multiline, units, i); n != 0 {
+			i += n - 1
+			e = entries[i]
+		} else {
 			entry := e.AsMapEntry()
 			k := entry.Key()
-			un.WriteNewLine()
 			if entry.IsOptional() {
-				for _, c := range un.CommentBlock(e.ID()) {
-					un.WriteString(c)
-					un.WriteNewLine()
+				if multiline {
+					un.writeCommentBlock(e.ID())
 				}
 				un.WriteString("?")
 			}
@@ -794,40 +1239,99 @@ func (un *formatter) visitStructMap(expr ast.Expr) error {
 			if err != nil {
 				return err
 			}
-			if un.options.alwaysComma || i < len(entries)-1 {
-				un.WriteString(",")
-			}
-			un.WriteString(un.Comment(un.lastChild(entry.Value()).ID()))
 		}
-		un.indent--
-		un.WriteNewLine()
-		un.WriteString("}")
-	} else {
-		for i, e := range entries {
-			entry := e.AsMapEntry()
-			k := entry.Key()
-			if entry.IsOptional() {
-				un.WriteString("?")
-			}
-			err := un.visit(k, false)
-			if err != nil {
-				return err
-			}
-			un.WriteString(": ")
-			v := entry.Value()
-			err = un.visit(v, false)
-			if err != nil {
-				return err
-			}
-			if i < len(entries)-1 {
-				un.WriteString(", ")
-			}
+		un.writeComma(i, len(entries))
+		if multiline {
+			un.writeUnitComment(units[i])
 		}
-		un.WriteString("}")
 	}
+	if multiline && len(units) != 0 {
+		un.writeClosingDirectives(expr, units[len(units)-1])
+	}
+	un.closeGroup()
+	un.WriteLine("")
+	un.closeGroup()
+	un.WriteString("}")
 	return nil
 }
 
+// writeSeparator writes the line break before the element of a list, map
+// or message with the index i.
+func (un *formatter) writeSeparator(i int) {
+	if i == 0 {
+		un.WriteLine("")
+	} else {
+		un.WriteLine(" ")
+	}
+	un.between = true
+}
+
+// writeComma writes the comma following the element of a list, map or
+// message with the index i of n elements. The last element is only
+// followed by a comma when the elements are broken over lines.
+func (un *formatter) writeComma(i, n int) {
+	switch {
+	case i < n-1:
+		un.WriteString(",")
+	case un.options.alwaysComma:
+		un.WriteIf(docText(","), nil)
+	}
+}
+
+// protected writes the units starting with units[i] verbatim if they are
+// protected by a directive and the expression holding them spans lines in
+// the source, and returns the number of units written.
+func (un *formatter) protected(multiline bool, units []unit, i int) int {
+	if !multiline {
+		return 0
+	}
+	return un.writeProtected(units, i)
+}
+
+// writeCommentBlock writes the comments preceding the expression with the
+// given ID, each on a line of its own.
+func (un *formatter) writeCommentBlock(id int64) {
+	un.writeCommentLines(un.CommentBlock(id))
+}
+
+// writeCommentLines writes the lines of a comment block. A blank line
+// starting the block is only written before an element of a list, map or
+// message or an argument of a call, and only when they are broken over
+// lines, so that blank lines separating related elements are kept without
+// breaking lines elsewhere.
+func (un *formatter) writeCommentLines(lines []string) {
+	if len(lines) != 0 && lines[0] == "" {
+		if un.between {
+			blank := &docGroup{docs: []doc{docText(""), docLine{indent: un.indent, hard: true}}, hard: true}
+			un.WriteIf(blank, nil)
+		}
+		lines = lines[1:]
+	}
+	for _, c := range lines {
+		un.WriteString(c)
+		un.WriteNewLine()
+	}
+}
+
+// isMemberCall returns whether expr is a member call or a macro expanded
+// from one.
+func (un *formatter) isMemberCall(expr ast.Expr) bool {
+	if call, ok := un.info.GetMacroCall(expr.ID()); ok {
+		expr = call
+	}
+	return expr.Kind() == ast.CallKind && expr.AsCall().IsMemberFunction()
+}
+
+// writeCallComments writes the comments preceding the member call expr,
+// which was expanded to the expression with the given ID if it is a macro
+// call.
+func (un *formatter) writeCallComments(expr ast.Expr, id int64) {
+	un.writeCommentBlock(id)
+	if id != expr.ID() {
+		un.writeCommentBlock(expr.ID())
+	}
+}
+
 func (un *formatter) visitMaybeMacroCall(expr ast.Expr) (bool, error) {
 	call, found := un.info.GetMacroCall(expr.ID())
 	if !found {
@@ -837,40 +1341,27 @@ func (un *formatter) visitMaybeMacroCall(expr ast.Expr) (bool, error) {
 }
 
 func (un *formatter) visitMaybeNested(expr ast.Expr, nested bool) error {
+	if !nested {
+		return un.visit(expr, false)
+	}
 	// Use multiline format if the expression spans multiple lines OR if it has
 	// preceding comments (which would span multiple lines when written).
 	// We check the entire expression tree for comments since comments may be
 	// associated with descendant expressions.
-	multiline := un.isMultiline(expr) || (nested && un.hasCommentsInTree(expr))
+	multiline := un.isMultiline(expr) || un.hasCommentsInTree(expr)
 
-	if multiline {
-		if nested {
-			un.indent++
-			un.WriteString("(")
-			un.WriteNewLine()
-		}
-		err := un.visit(expr, false)
-		if err != nil {
-			return err
-		}
-		if nested {
-			un.indent--
-			un.WriteNewLine()
-			un.WriteString(")")
-		}
-	} else {
-		if nested {
-			un.WriteString("(")
-		}
-		err := un.visit(expr, false)
-		if err != nil {
-			return err
-		}
-		if nested {
-			un.WriteString(")")
-		}
+	un.WriteString("(")
+	un.openGroup(multiline)
+	un.openNest()
+	un.WriteLine("")
+	err := un.visit(expr, false)
+	if err != nil {
+		return err
 	}
-
+	un.closeGroup()
+	un.WriteLine("")
+	un.closeGroup()
+	un.WriteString(")")
 	return nil
 }
 
@@ -896,12 +1387,14 @@ func (un *formatter) hasCommentsForExpr(id int64) bool {
 	if !un.options.pretty {
 		return false
 	}
+	if un.cmap != nil {
+		return !un.emitted[commentKey{id, LeadingComment}] &&
+			slices.ContainsFunc(un.cmap[id].Leading, func(c Comment) bool { return c.Text != "" })
+	}
 	start := un.info.GetStartLocation(id)
 	first := true
 	for line := start.Line(); line > 0; line-- {
-		text, ok := un.src.Snippet(line)
-		comment := strings.TrimSpace(text)
-		if !ok || (comment != "" && !strings.HasPrefix(comment, "//")) {
+		if un.text.lineKind(line) == codeLine {
 			if first {
 				first = false
 				continue
@@ -909,14 +1402,17 @@ func (un *formatter) hasCommentsForExpr(id int64) bool {
 			break
 		}
 		first = false
-		loc := location{line, strings.Index(text, comment)}
+		if un.ignoring(line) {
+			break
+		}
+		loc, comment := un.lineComment(line)
 		if cid, ok := un.comments[loc]; ok {
 			if cid != id {
 				return false
 			}
 			break
 		}
-		if comment != "" {
+		if comment.Text != "" {
 			return true
 		}
 	}
@@ -1071,48 +1567,19 @@ func bytesToOctets(byteVal []byte) string {
 }
 
 // writeOperatorWithWrapping outputs the operator and inserts a newline for operators configured
-// in the unparser options.
-func (un *formatter) writeOperatorWithWrapping(fun, unmangled string) bool {
-	_, wrapOperatorExists := un.options.operatorsToWrapOn[fun]
-	lineLength := un.dst.Len() - un.lastWrappedIndex + len(fun)
-
-	if wrapOperatorExists && lineLength >= un.options.wrapOnColumn {
-		un.lastWrappedIndex = un.dst.Len()
-		// wrapAfterColumnLimit flag dictates whether the newline is placed
-		// before or after the operator
-		if un.options.wrapAfterColumnLimit {
-			// Input: a && b
-			// Output: a &&\nb
-			un.WriteString(" ")
-			un.WriteString(unmangled)
-			if un.options.pretty {
-				un.WriteNewLine()
-			} else {
-				un.WriteString("\n")
-			}
-		} else {
-			// Input: a && b
-			// Output: a\n&& b
-			if un.options.pretty {
-				un.WriteNewLine()
-			} else {
-				un.WriteString("\n")
-			}
-			un.WriteString(unmangled)
-			un.WriteString(" ")
-		}
-		return true
+// in the unparser options, or after the trailing comment of the lhs operand if there is one.
+func (un *formatter) writeOperatorWithWrapping(fun, unmangled, comment string) {
+	un.add(docWrap{fun: fun, op: unmangled, indent: un.indent, comment: comment})
+	if comment != "" {
+		un.commented()
 	}
-	un.WriteString(" ")
-	un.WriteString(unmangled)
-	un.WriteString(" ")
-	return false
 }
 
 // Defined defaults for the unparser options
 var (
 	defaultWrapOnColumn         = 80
 	defaultWrapAfterColumnLimit = true
+	defaultAlignComments        = true
 	defaultIndentString         = "\t"
 	defaultOperatorsToWrapOn    = map[string]bool{
 		operators.LogicalAnd: true,
@@ -1120,6 +1587,31 @@ var (
 	}
 )
 
+// ValidateOptions returns the error that Format would return when given
+// the provided options, if any.
+func ValidateOptions(opts ...FormatOption) error {
+	_, err := applyOptions(opts)
+	return err
+}
+
+func applyOptions(opts []FormatOption) (*unparserOption, error) {
+	unparserOpts := &unparserOption{
+		wrapOnColumn:         defaultWrapOnColumn,
+		wrapAfterColumnLimit: defaultWrapAfterColumnLimit,
+		alignComments:        defaultAlignComments,
+		operatorsToWrapOn:    defaultOperatorsToWrapOn,
+		indent:               defaultIndentString,
+	}
+	var err error
+	for _, opt := range opts {
+		unparserOpts, err = opt(unparserOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unparserOpts, nil
+}
+
 // FormatOption is a functional option for configuring the output formatting
 // of the Unparse function.
 type FormatOption func(*unparserOption) (*unparserOption, error)
@@ -1131,9 +1623,20 @@ type unparserOption struct {
 	wrapAfterColumnLimit bool
 	pretty               bool
 	alwaysComma          bool
+	strictComments       bool
+	alignComments        bool
+	layout               LayoutMode
 
 	// indent is the string to be repeated for indented lines.
 	indent string
+
+	// droppedComments receives the comments that could not be
+	// placed in the output.
+	droppedComments *[]DroppedComment
+
+	// comments, if not nil, holds the comments to place in the
+	// output in place of those found in the source.
+	comments CommentMap
 }
 
 // Pretty enables pretty printing of the output expression.
@@ -1144,6 +1647,43 @@ func Pretty() FormatOption {
 	}
 }
 
+// LayoutMode selects how expressions are broken over lines when pretty
+// printing.
+type LayoutMode int
+
+const (
+	// SourceLayout breaks a list, map, message, call, ternary or
+	// parenthesized expression over lines when it spans more than one
+	// line in the source, and writes it on one line otherwise.
+	SourceLayout LayoutMode = iota
+
+	// WidthLayout breaks the expressions that SourceLayout breaks,
+	// and also those that would extend a line beyond the wrap column.
+	// An expression is broken before the expressions within it, and
+	// a chain of two or more member calls is broken before each call
+	// when the text before its first argument list is too long.
+	WidthLayout
+
+	// CanonicalLayout breaks only the expressions that would extend
+	// a line beyond the wrap column or that hold comments, as the
+	// WidthLayout mode does, and writes all others on one line. The
+	// layout depends on the expression and the wrap column, and not
+	// on how the source is broken over lines.
+	CanonicalLayout
+)
+
+// Layout sets the layout mode used when pretty printing. If not set this
+// defaults to SourceLayout.
+func Layout(mode LayoutMode) FormatOption {
+	return func(opt *unparserOption) (*unparserOption, error) {
+		if mode < SourceLayout || mode > CanonicalLayout {
+			return nil, fmt.Errorf("Invalid unparser option. Unknown layout mode: %d", mode)
+		}
+		opt.layout = mode
+		return opt, nil
+	}
+}
+
 // AlwaysComma forces a comma to be printed after the last element of a list or map.
 func AlwaysComma() FormatOption {
 	return func(opt *unparserOption) (*unparserOption, error) {
@@ -1165,6 +1705,8 @@ func IndentString(s string) FormatOption {
 
 // WrapOnColumn wraps the output expression when its string length exceeds a specified limit
 // for operators set by WrapOnOperators function or by default, "&&" and "||" will be wrapped.
+// With the WidthLayout and CanonicalLayout modes, the limit is also the width that expressions
+// are broken over lines to fit within.
 //
 // Example usage:
 //
@@ -1236,3 +1778,46 @@ func WrapAfterColumnLimit(wrapAfter bool) FormatOption {
 		return opt, nil
 	}
 }
+
+// StrictComments makes Format return an error for each comment in the source
+// that could not be placed in the output. Comments are only retained when
+// pretty printing, so this has no effect without the Pretty option.
+func StrictComments() FormatOption {
+	return func(opt *unparserOption) (*unparserOption, error) {
+		opt.strictComments = true
+		return opt, nil
+	}
+}
+
+// AlignComments specifies whether to align the trailing comments of
+// consecutive lines that have the same indentation, as gofmt does. By
+// default, comments are aligned. Comments are only retained when pretty
+// printing, so this has no effect without the Pretty option.
+func AlignComments(align bool) FormatOption {
+	return func(opt *unparserOption) (*unparserOption, error) {
+		opt.alignComments = align
+		return opt, nil
+	}
+}
+
+// DroppedComments stores the comments in the source that could not be placed
+// in the output in *dst when pretty printing.
+func DroppedComments(dst *[]DroppedComment) FormatOption {
+	return func(opt *unparserOption) (*unparserOption, error) {
+		opt.droppedComments = dst
+		return opt, nil
+	}
+}
+
+// Comments places the comments held by m in the output rather than the
+// comments found in the source. The leading and trailing comments of each
+// expression are written before it and at the end of its line, and the
+// dangling comments of the root expression after the program. Any other
+// comments in m are dropped. Comments are only written when pretty
+// printing.
+func Comments(m CommentMap) FormatOption {
+	return func(opt *unparserOption) (*unparserOption, error) {
+		opt.comments = m
+		return opt, nil
+	}
+}
@@ -27,6 +27,8 @@ import (
 )
 
 func TestFormat(t *testing.T) {
+	widthOptions := []FormatOption{Pretty(), AlwaysComma(), IndentString("  "), WrapOnColumn(30), Layout(WidthLayout)}
+	canonicalOptions := []FormatOption{Pretty(), AlwaysComma(), IndentString("  "), WrapOnColumn(30), Layout(CanonicalLayout)}
 	tests := []struct {
 		name               string
 		in                 string
@@ -445,6 +447,149 @@ func TestFormat(t *testing.T) {
 				WrapOnColumn(3),
 			},
 		},
+		{
+			// Expressions are broken over lines when they would
+			// extend beyond the wrap column with the width layout.
+			name:            "width_call",
+			in:              `request("GET", state.url + "/path", {"a": 1})`,
+			out:             "request(\n  \"GET\",\n  state.url + \"/path\",\n  {\"a\": 1}\n)",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:            "width_list",
+			in:              `[first_element, second_element, third_element]`,
+			out:             "[\n  first_element,\n  second_element,\n  third_element,\n]",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:            "width_list_fits",
+			in:              `[1, 2, 3]`,
+			unparserOptions: widthOptions,
+		},
+		{
+			name:            "width_map",
+			in:              `{"first": first_value, "second": second_value}`,
+			out:             "{\n  \"first\": first_value,\n  \"second\": second_value,\n}",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:            "width_ternary",
+			in:              `condition_one ? first_value_here : second_value_here`,
+			out:             "condition_one ?\n  first_value_here\n:\n  second_value_here",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:            "width_chain",
+			in:              `state.url.trim_right("/").split("/").size()`,
+			out:             "state.url\n  .trim_right(\"/\")\n  .split(\"/\")\n  .size()",
+			unparserOptions: widthOptions,
+		},
+		{
+			// Comments following the targets of chained calls
+			// end the lines of the broken chain.
+			name:            "width_chain_comment",
+			in:              "state.url.trim_right(\"/\") // a\n  .trim_left(\"x\") // b\n  .trim_right(\"y\")",
+			out:             "state.url\n  .trim_right(\"/\") // a\n  .trim_left(\"x\")  // b\n  .trim_right(\"y\")",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:            "width_chain_tail",
+			in:              `state.with({"header": {"authorization": token}})`,
+			out:             "state.with({\n  \"header\": {\n    \"authorization\": token,\n  },\n})",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:               "width_macro",
+			in:                 `items.filter(item, item.name != "" && item.value > 0).size()`,
+			out:                "items\n  .filter(item,\n    item.name != \"\" &&\n    item.value > 0\n  )\n  .size()",
+			requiresMacroCalls: true,
+			unparserOptions:    widthOptions,
+		},
+		{
+			// Lines are wrapped at binary operators rather than
+			// breaking short calls within the operands.
+			name:            "width_concatenation",
+			in:              `request("GET", state.url + "?page=" + string(state.page) + "&size=" + string(state.size))`,
+			out:             "request(\n  \"GET\",\n  state.url + \"?page=\" +\n  string(state.page) +\n  \"&size=\" +\n  string(state.size)\n)",
+			unparserOptions: widthOptions,
+		},
+		{
+			name:               "width_macro_hug",
+			in:                 `items.map(item, {"name": item.name, "value": item.value})`,
+			out:                "items.map(item, {\n  \"name\": item.name,\n  \"value\": item.value,\n})",
+			requiresMacroCalls: true,
+			unparserOptions:    widthOptions,
+		},
+		{
+			// Expressions broken in the source are joined when they
+			// fit with the canonical layout.
+			name:            "canonical_list",
+			in:              "[\n  1,\n  2,\n]",
+			out:             "[1, 2]",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			name:            "canonical_map",
+			in:              "{\"a\": 1,\n  \"b\": [\n  2]}",
+			out:             `{"a": 1, "b": [2]}`,
+			unparserOptions: canonicalOptions,
+		},
+		{
+			name:            "canonical_call",
+			in:              `request("GET", state.url + "/path", {"a": 1})`,
+			out:             "request(\n  \"GET\",\n  state.url + \"/path\",\n  {\"a\": 1}\n)",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			name:            "canonical_ternary",
+			in:              "a ?\n  b\n:\n  c",
+			out:             "a ? b : c",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			name:            "canonical_chain",
+			in:              "a\n  .b()\n  .c()",
+			out:             "a.b().c()",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			name:               "canonical_macro",
+			in:                 "items.map(item,\n  item.name\n)",
+			out:                "items.map(item, item.name)",
+			requiresMacroCalls: true,
+			unparserOptions:    canonicalOptions,
+		},
+		{
+			name:               "canonical_macro_hug",
+			in:                 "items.map(item,\n  {\"name\": item.name, \"value\": item.value}\n)",
+			out:                "items.map(item, {\n  \"name\": item.name,\n  \"value\": item.value,\n})",
+			requiresMacroCalls: true,
+			unparserOptions:    canonicalOptions,
+		},
+		{
+			name:            "canonical_chain_comment",
+			in:              "a\n  .b() // b\n  .c()",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			// Comments still break the expressions holding them.
+			name:            "canonical_comment",
+			in:              "[\n  1, // one\n  2,\n]",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			// Blank lines between elements are kept only when
+			// the elements are broken over lines.
+			name:            "canonical_blank_line",
+			in:              "[\n  1,\n\n  2,\n]",
+			out:             "[1, 2]",
+			unparserOptions: canonicalOptions,
+		},
+		{
+			name:            "canonical_blank_line_broken",
+			in:              "[\n  first_element,\n\n  second_element,\n]",
+			unparserOptions: canonicalOptions,
+		},
 	}
 
 	for _, test := range tests {
@@ -494,3 +639,44 @@ func TestFormat(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []FormatOption
+		wantErr string
+	}{
+		{name: "none"},
+		{
+			name: "valid",
+			opts: []FormatOption{Pretty(), AlwaysComma(), IndentString("  "), WrapOnColumn(40), WrapOnOperators(operators.LogicalOr), WrapAfterColumnLimit(false)},
+		},
+		{
+			name:    "bad_column",
+			opts:    []FormatOption{WrapOnColumn(0)},
+			wantErr: "Invalid unparser option. Wrap column value must be greater than or equal to 1. Got 0 instead",
+		},
+		{
+			name:    "bad_layout",
+			opts:    []FormatOption{Layout(99)},
+			wantErr: "Invalid unparser option. Unknown layout mode: 99",
+		},
+		{
+			name:    "unary_operator",
+			opts:    []FormatOption{WrapOnOperators(operators.LogicalNot)},
+			wantErr: "Invalid unparser option. Unary operators are unsupported: !_",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateOptions(test.opts...)
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != test.wantErr {
+				t.Errorf("unexpected error: got:%q want:%q", got, test.wantErr)
+			}
+		})
+	}
+}
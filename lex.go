@@ -0,0 +1,349 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sourceText is the lexical structure of a program's source: its comments
+// and which lines hold code. Strings are code, so text within a string
+// literal that looks like a comment is not taken to be one.
+type sourceText struct {
+	src string
+
+	// comments holds all the comments in the source in order.
+	comments []sourceComment
+
+	// tokens holds the extents of the tokens that are not comments,
+	// in order.
+	tokens []span
+
+	// lines holds the kind of each line, indexed by line number.
+	// Index zero is unused.
+	lines []lineKind
+
+	// byLine holds the index in comments of the comment on each
+	// line that has one.
+	byLine map[int]int
+
+	// end and endLine are the byte offset and line of the end of
+	// the last token that is not a comment.
+	end, endLine int
+
+	// off holds the regions between celfmt:off and celfmt:on
+	// directives, and ignores holds the indices in comments of
+	// celfmt:ignore directives.
+	off     []span
+	ignores []int
+}
+
+// span is the extent of a part of the source in bytes.
+type span struct {
+	start, end int
+}
+
+// holds returns whether s holds the byte offset i.
+func (s span) holds(i int) bool {
+	return s.start <= i && i < s.end
+}
+
+// contains returns whether s contains all of o.
+func (s span) contains(o span) bool {
+	return s.start <= o.start && o.end <= s.end
+}
+
+// overlaps returns whether s and o have any part in common.
+func (s span) overlaps(o span) bool {
+	return s.start < o.end && o.start < s.end
+}
+
+// lineKind is the classification of a line of source.
+type lineKind int
+
+const (
+	blankLine   lineKind = iota // only white space
+	commentLine                 // a comment and white space
+	codeLine                    // code, possibly followed by a comment
+)
+
+// sourceComment is a // comment in the source text.
+type sourceComment struct {
+	line    int    // 1-based line of the comment
+	col     int    // byte offset of the "//" within its line
+	runeCol int    // rune offset of the "//" within its line
+	offset  int    // byte offset of the "//" within the source
+	text    string // the comment from "//" to the end of the line
+}
+
+// lexSource returns the lexical structure of src. It distinguishes
+// comments, string and bytes literals, including triple-quoted and raw
+// literals, and other code. Invalid input is lexed on a best-effort basis
+// since it is rejected by the parser.
+func lexSource(src string) *sourceText {
+	t := &sourceText{
+		src:    src,
+		lines:  make([]lineKind, strings.Count(src, "\n")+2),
+		byLine: make(map[int]int),
+	}
+	line, lineStart := 1, 0
+	// token records the code token src[start:end], which may span
+	// lines if it is a string literal.
+	token := func(start, end int) {
+		t.lines[line] = codeLine
+		for j := start; j < end; j++ {
+			if src[j] == '\n' {
+				line++
+				lineStart = j + 1
+				t.lines[line] = codeLine
+			}
+		}
+		t.tokens = append(t.tokens, span{start, end})
+		t.end, t.endLine = end, line
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		end := i + 1
+		switch {
+		case c == '\n':
+			line++
+			lineStart = end
+			i = end
+			continue
+		case c < utf8.RuneSelf && unicode.IsSpace(rune(c)):
+			i = end
+			continue
+		case c == '/' && strings.HasPrefix(src[i:], "//"):
+			text, _, _ := strings.Cut(src[i:], "\n")
+			if t.lines[line] == blankLine {
+				t.lines[line] = commentLine
+			}
+			t.byLine[line] = len(t.comments)
+			t.comments = append(t.comments, sourceComment{
+				line:    line,
+				col:     i - lineStart,
+				runeCol: utf8.RuneCountInString(src[lineStart:i]),
+				offset:  i,
+				text:    strings.TrimRight(text, "\r"),
+			})
+			i += len(text)
+			continue
+		case c == '"' || c == '\'':
+			end = stringEnd(src, i, false)
+		case c == '`':
+			// Quoted identifiers in field selections do not
+			// span lines.
+			for end < len(src) && src[end] != '`' && src[end] != '\n' {
+				end++
+			}
+			if end < len(src) && src[end] == '`' {
+				end++
+			}
+		case isDigit(c) || c == '.' && end < len(src) && isDigit(src[end]):
+			end = numberEnd(src, i)
+		case isIdentStart(c):
+			for end < len(src) && isIdentPart(src[end]) {
+				end++
+			}
+			if end < len(src) && (src[end] == '"' || src[end] == '\'') && isStringPrefix(src[i:end]) {
+				end = stringEnd(src, end, strings.ContainsAny(src[i:end], "rR"))
+			}
+		default:
+			_, n := utf8.DecodeRuneInString(src[i:])
+			end = i + n
+		}
+		token(i, end)
+		i = end
+	}
+	t.directives()
+	return t
+}
+
+// Token is a lexical token of a program's source.
+type Token struct {
+	Text    string // the text of the token
+	Offset  int    // byte offset of the token in the source
+	Comment bool   // whether the token is a // comment
+}
+
+// Tokens returns the tokens of src in order, including its comments, as
+// they are lexed to place comments. A string literal, including any prefix,
+// is a single token. Invalid input is lexed on a best-effort basis.
+func Tokens(src string) []Token {
+	t := lexSource(src)
+	toks := make([]Token, 0, len(t.tokens)+len(t.comments))
+	comments := t.comments
+	for _, s := range t.tokens {
+		for len(comments) != 0 && comments[0].offset < s.start {
+			toks = append(toks, Token{Text: comments[0].text, Offset: comments[0].offset, Comment: true})
+			comments = comments[1:]
+		}
+		toks = append(toks, Token{Text: src[s.start:s.end], Offset: s.start})
+	}
+	for _, c := range comments {
+		toks = append(toks, Token{Text: c.text, Offset: c.offset, Comment: true})
+	}
+	return toks
+}
+
+// numberEnd returns the offset just past the numeric literal starting at
+// offset i in src.
+func numberEnd(src string, i int) int {
+	j := i
+	digits := func(valid func(byte) bool) {
+		for j < len(src) && valid(src[j]) {
+			j++
+		}
+	}
+	if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+		j += 2
+		digits(isHexDigit)
+	} else {
+		digits(isDigit)
+		if j+1 < len(src) && src[j] == '.' && isDigit(src[j+1]) {
+			j++
+			digits(isDigit)
+		}
+		if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+			k := j + 1
+			if k < len(src) && (src[k] == '+' || src[k] == '-') {
+				k++
+			}
+			if k < len(src) && isDigit(src[k]) {
+				j = k
+				digits(isDigit)
+			}
+		}
+	}
+	if j < len(src) && (src[j] == 'u' || src[j] == 'U') {
+		j++
+	}
+	return j
+}
+
+// stringEnd returns the offset just past the string literal whose opening
+// quote is at offset i in src. Escapes are not interpreted in raw literals.
+// Unterminated literals that are not triple-quoted end at the end of the
+// line, and triple-quoted literals at the end of the source.
+func stringEnd(src string, i int, raw bool) int {
+	quote := src[i : i+1]
+	if strings.HasPrefix(src[i:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	triple := len(quote) == 3
+	for j := i + len(quote); j < len(src); j++ {
+		switch {
+		case src[j] == '\\' && !raw:
+			j++
+		case src[j] == '\n' && !triple:
+			return j
+		case strings.HasPrefix(src[j:], quote):
+			return j + len(quote)
+		}
+	}
+	return len(src)
+}
+
+// isStringPrefix returns whether s is a valid string literal prefix.
+func isStringPrefix(s string) bool {
+	switch strings.ToLower(s) {
+	case "r", "b", "rb", "br":
+		return true
+	default:
+		return false
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// lineKind returns the kind of the given line. Lines outside the source
+// are code so that they end any search for comments.
+func (t *sourceText) lineKind(line int) lineKind {
+	if line <= 0 || line >= len(t.lines) {
+		return codeLine
+	}
+	return t.lines[line]
+}
+
+// line returns the line holding the byte offset i.
+func (t *sourceText) line(i int) int {
+	return strings.Count(t.src[:i], "\n") + 1
+}
+
+// locate returns the byte offset of the code point column col on the
+// 1-based line.
+func (t *sourceText) locate(line, col int) int {
+	i := 0
+	for ; line > 1; line-- {
+		j := strings.IndexByte(t.src[i:], '\n')
+		if j < 0 {
+			return len(t.src)
+		}
+		i += j + 1
+	}
+	for ; col > 0 && i < len(t.src); col-- {
+		_, n := utf8.DecodeRuneInString(t.src[i:])
+		i += n
+	}
+	return i
+}
+
+// tokenAt returns the index in tokens of the token starting at the byte
+// offset i, if there is one.
+func (t *sourceText) tokenAt(i int) (int, bool) {
+	k := sort.Search(len(t.tokens), func(k int) bool {
+		return t.tokens[k].start >= i
+	})
+	return k, k < len(t.tokens) && t.tokens[k].start == i
+}
+
+// offset returns the byte offset of the comment c, if it is from the
+// source.
+func (t *sourceText) offset(c Comment) (int, bool) {
+	sc, ok := t.comment(c.Line)
+	if !ok || sc.runeCol+1 != c.Column {
+		return 0, false
+	}
+	return sc.offset, true
+}
+
+// comment returns the comment on the given line, if any.
+func (t *sourceText) comment(line int) (sourceComment, bool) {
+	i, ok := t.byLine[line]
+	if !ok {
+		return sourceComment{}, false
+	}
+	return t.comments[i], true
+}
@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"slices"
+	"testing"
+)
+
+var lexSourceTests = []struct {
+	name         string
+	src          string
+	wantComments []string
+	wantLines    []lineKind // from line 1
+	wantEndLine  int
+	wantTokens   []string // checked if not nil
+}{
+	{
+		name:         "comments",
+		src:          "// lead\n\na + b // trail\n// end",
+		wantComments: []string{"// lead", "// trail", "// end"},
+		wantLines:    []lineKind{commentLine, blankLine, codeLine, commentLine},
+		wantEndLine:  3,
+	},
+	{
+		name:         "strings",
+		src:          `f("http://a", 'b//c', "\"//", '\'//') // c`,
+		wantComments: []string{"// c"},
+		wantLines:    []lineKind{codeLine},
+		wantEndLine:  1,
+	},
+	{
+		name:         "raw_strings",
+		src:          `[r"\", R'\', rb"//", Br'\'] // c`,
+		wantComments: []string{"// c"},
+		wantLines:    []lineKind{codeLine},
+		wantEndLine:  1,
+	},
+	{
+		name:         "triple_quoted",
+		src:          "[\"\"\"\n// a\n\n\"\"\", b'''// b\n'''] // c",
+		wantComments: []string{"// c"},
+		wantLines:    []lineKind{codeLine, codeLine, codeLine, codeLine, codeLine},
+		wantEndLine:  5,
+	},
+	{
+		name:         "identifiers",
+		src:          "rb + br // c\na.`b//c`",
+		wantComments: []string{"// c"},
+		wantLines:    []lineKind{codeLine, codeLine},
+		wantEndLine:  2,
+	},
+	{
+		name:         "numbers",
+		src:          "[1.5e-3, .5, 0x1Fu, 2u, 1.size(), -1] // c",
+		wantComments: []string{"// c"},
+		wantLines:    []lineKind{codeLine},
+		wantEndLine:  1,
+		wantTokens:   []string{"[", "1.5e-3", ",", ".5", ",", "0x1Fu", ",", "2u", ",", "1", ".", "size", "(", ")", ",", "-", "1", "]"},
+	},
+	{
+		name:         "unterminated",
+		src:          "\"a // b\n// c",
+		wantComments: []string{"// c"},
+		wantLines:    []lineKind{codeLine, commentLine},
+		wantEndLine:  1,
+	},
+}
+
+func TestLexSource(t *testing.T) {
+	for _, test := range lexSourceTests {
+		t.Run(test.name, func(t *testing.T) {
+			text := lexSource(test.src)
+			var comments []string
+			for _, c := range text.comments {
+				comments = append(comments, c.text)
+			}
+			if !slices.Equal(comments, test.wantComments) {
+				t.Errorf("unexpected comments: got:%q want:%q", comments, test.wantComments)
+			}
+			if lines := text.lines[1:]; !slices.Equal(lines, test.wantLines) {
+				t.Errorf("unexpected line kinds: got:%v want:%v", lines, test.wantLines)
+			}
+			if text.endLine != test.wantEndLine {
+				t.Errorf("unexpected end line: got:%d want:%d", text.endLine, test.wantEndLine)
+			}
+			if test.wantTokens != nil {
+				var tokens []string
+				for _, tok := range text.tokens {
+					tokens = append(tokens, test.src[tok.start:tok.end])
+				}
+				if !slices.Equal(tokens, test.wantTokens) {
+					t.Errorf("unexpected tokens: got:%q want:%q", tokens, test.wantTokens)
+				}
+			}
+		})
+	}
+}
+
+func TestTokens(t *testing.T) {
+	src := "// lead\nf(r\"//\", 1) // trail\n.g()"
+	want := []Token{
+		{Text: "// lead", Offset: 0, Comment: true},
+		{Text: "f", Offset: 8},
+		{Text: "(", Offset: 9},
+		{Text: `r"//"`, Offset: 10},
+		{Text: ",", Offset: 15},
+		{Text: "1", Offset: 17},
+		{Text: ")", Offset: 18},
+		{Text: "// trail", Offset: 20, Comment: true},
+		{Text: ".", Offset: 29},
+		{Text: "g", Offset: 30},
+		{Text: "(", Offset: 31},
+		{Text: ")", Offset: 32},
+	}
+	got := Tokens(src)
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected tokens:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package mitoenv builds CEL environments for programs run by mito and the
+// Elastic Agent CEL input. The environments are suitable for use with
+// celfmt.Format, having macro call tracking enabled.
+package mitoenv
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/elastic/mito/lib"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+)
+
+// Env is a CEL environment with mito extension libraries.
+type Env struct {
+	*cel.Env
+
+	libraries []string
+}
+
+// Libraries returns the names of the mito extension libraries enabled in
+// the environment, in sorted order.
+func (e *Env) Libraries() []string {
+	return slices.Clone(e.libraries)
+}
+
+// Option is a functional option for configuring the environment built by
+// New.
+type Option func(*options) (*options, error)
+
+type options struct {
+	vars      []*decls.VariableDecl
+	libraries []string
+	envOpts   []cel.EnvOption
+}
+
+// Variables declares the variables of the environment, replacing the
+// default state and useragent variables.
+func Variables(vars ...*decls.VariableDecl) Option {
+	return func(opt *options) (*options, error) {
+		opt.vars = vars
+		return opt, nil
+	}
+}
+
+// Libraries selects the mito extension libraries to enable by name. By
+// default all libraries are enabled.
+func Libraries(names ...string) Option {
+	return func(opt *options) (*options, error) {
+		for _, name := range names {
+			if _, ok := libraries[name]; !ok {
+				return nil, fmt.Errorf("unknown library: %s", name)
+			}
+		}
+		opt.libraries = slices.Sorted(slices.Values(names))
+		opt.libraries = slices.Compact(opt.libraries)
+		return opt, nil
+	}
+}
+
+// EnvOptions adds CEL environment options to apply after the mito
+// libraries.
+func EnvOptions(envOpts ...cel.EnvOption) Option {
+	return func(opt *options) (*options, error) {
+		opt.envOpts = append(opt.envOpts, envOpts...)
+		return opt, nil
+	}
+}
+
+// New returns a CEL environment holding the configured variables and mito
+// extension libraries, with optional types, two-variable comprehensions and
+// macro call tracking enabled.
+func New(opts ...Option) (*Env, error) {
+	cfg := &options{
+		vars: []*decls.VariableDecl{
+			decls.NewVariable("state", types.DynType),
+			decls.NewVariable("useragent", types.StringType),
+		},
+		libraries: LibraryNames(),
+	}
+	var err error
+	for _, opt := range opts {
+		cfg, err = opt(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	envOpts := []cel.EnvOption{cel.VariableDecls(cfg.vars...)}
+	for _, name := range cfg.libraries {
+		opt, err := libraries[name]()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize %s library: %w", name, err)
+		}
+		envOpts = append(envOpts, opt)
+	}
+	envOpts = append(envOpts,
+		cel.OptionalTypes(cel.OptionalTypesVersion(lib.OptionalTypesVersion)),
+		ext.TwoVarComprehensions(ext.TwoVarComprehensionsVersion(lib.OptionalTypesVersion)),
+		cel.EnableMacroCallTracking(),
+	)
+	env, err := cel.NewEnv(append(envOpts, cfg.envOpts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Env{Env: env, libraries: cfg.libraries}, nil
+}
+
+// LibraryNames returns the names of all the mito extension libraries that
+// may be selected with Libraries, in sorted order.
+func LibraryNames() []string {
+	return slices.Sorted(maps.Keys(libraries))
+}
+
+// libraries holds the mito extension libraries by name. Libraries that
+// perform I/O or logging are configured without effect as programs are
+// not evaluated.
+var libraries = map[string]func() (cel.EnvOption, error){
+	"collections": func() (cel.EnvOption, error) { return lib.Collections(), nil },
+	"crypto":      func() (cel.EnvOption, error) { return lib.Crypto(), nil },
+	"debug":       func() (cel.EnvOption, error) { return lib.Debug(func(_ string, _ any) {}), nil },
+	"file":        func() (cel.EnvOption, error) { return lib.File(nil), nil },
+	"http":        func() (cel.EnvOption, error) { return lib.HTTP(nil, nil, nil), nil },
+	"json":        func() (cel.EnvOption, error) { return lib.JSON(nil), nil },
+	"limit":       func() (cel.EnvOption, error) { return lib.Limit(nil), nil },
+	"mime":        func() (cel.EnvOption, error) { return lib.MIME(nil), nil },
+	"printf":      func() (cel.EnvOption, error) { return lib.Printf(), nil },
+	"regexp":      func() (cel.EnvOption, error) { return lib.Regexp(nil), nil },
+	"strings":     func() (cel.EnvOption, error) { return lib.Strings(), nil },
+	"time":        func() (cel.EnvOption, error) { return lib.Time(), nil },
+	"try":         func() (cel.EnvOption, error) { return lib.Try(), nil },
+	"xml":         func() (cel.EnvOption, error) { return lib.XML(nil, nil) },
+}
@@ -0,0 +1,106 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package mitoenv
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+)
+
+var newTests = []struct {
+	name      string
+	opts      []Option
+	src       string
+	wantLibs  []string
+	wantErr   string
+	wantCheck string
+}{
+	{
+		name:     "default",
+		src:      `state.with({"ua": useragent, "now": now(), "body": bytes(state.body).decode_json()})`,
+		wantLibs: LibraryNames(),
+	},
+	{
+		name:     "macro_tracking",
+		src:      `[1, 2].map(x, x * 2)`,
+		wantLibs: LibraryNames(),
+	},
+	{
+		name:      "variables",
+		opts:      []Option{Variables(decls.NewVariable("n", types.IntType))},
+		src:       `state.n + n`,
+		wantLibs:  LibraryNames(),
+		wantCheck: "undeclared reference to 'state'",
+	},
+	{
+		name:      "libraries",
+		opts:      []Option{Libraries("strings", "collections", "strings")},
+		src:       `now()`,
+		wantLibs:  []string{"collections", "strings"},
+		wantCheck: "undeclared reference to 'now'",
+	},
+	{
+		name:     "env_options",
+		opts:     []Option{Libraries(), EnvOptions(cel.Variable("extra", cel.StringType))},
+		src:      `extra + useragent`,
+		wantLibs: []string{},
+	},
+	{
+		name:    "unknown_library",
+		opts:    []Option{Libraries("nope")},
+		wantErr: "unknown library: nope",
+	},
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range newTests {
+		t.Run(test.name, func(t *testing.T) {
+			env, err := New(test.opts...)
+			if err != nil {
+				if test.wantErr == "" || err.Error() != test.wantErr {
+					t.Fatalf("unexpected error: got:%v want:%q", err, test.wantErr)
+				}
+				return
+			}
+			if test.wantErr != "" {
+				t.Fatalf("expected error: %q", test.wantErr)
+			}
+			if got := env.Libraries(); !slices.Equal(got, test.wantLibs) {
+				t.Errorf("unexpected libraries: got:%q want:%q", got, test.wantLibs)
+			}
+			ast, iss := env.Compile(test.src)
+			if test.wantCheck != "" {
+				if iss.Err() == nil || !strings.Contains(iss.Err().Error(), test.wantCheck) {
+					t.Errorf("unexpected check result: got:%v want:%q", iss.Err(), test.wantCheck)
+				}
+				return
+			}
+			if iss.Err() != nil {
+				t.Fatalf("unexpected check error: %v", iss.Err())
+			}
+			if len(ast.NativeRep().SourceInfo().MacroCalls()) == 0 && strings.Contains(test.src, ".map(") {
+				t.Error("macro calls not tracked")
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package profiles
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+)
+
+// Opaque types of the Kubernetes CEL libraries.
+var (
+	k8sURL        = types.NewOpaqueType("kubernetes.URL")
+	k8sQuantity   = types.NewOpaqueType("kubernetes.Quantity")
+	k8sIP         = types.NewOpaqueType("net.IP")
+	k8sCIDR       = types.NewOpaqueType("net.CIDR")
+	k8sSemver     = types.NewOpaqueType("kubernetes.Semver")
+	k8sFormat     = types.NewOpaqueType("kubernetes.NamedFormat")
+	k8sAuthorizer = types.NewOpaqueType("kubernetes.authorization.Authorizer")
+	k8sPathCheck  = types.NewOpaqueType("kubernetes.authorization.PathCheck")
+	k8sGroupCheck = types.NewOpaqueType("kubernetes.authorization.GroupCheck")
+	k8sResource   = types.NewOpaqueType("kubernetes.authorization.ResourceCheck")
+	k8sDecision   = types.NewOpaqueType("kubernetes.authorization.Decision")
+)
+
+// k8sVars returns the variables available to ValidatingAdmissionPolicy
+// and MutatingAdmissionPolicy expressions.
+func k8sVars() []*decls.VariableDecl {
+	return []*decls.VariableDecl{
+		decls.NewVariable("object", types.DynType),
+		decls.NewVariable("oldObject", types.DynType),
+		decls.NewVariable("request", types.DynType),
+		decls.NewVariable("params", types.DynType),
+		decls.NewVariable("namespaceObject", types.DynType),
+		decls.NewVariable("variables", types.DynType),
+		decls.NewVariable("authorizer", k8sAuthorizer),
+		decls.NewVariable("self", types.DynType),
+		decls.NewVariable("oldSelf", types.DynType),
+	}
+}
+
+// k8sOptions returns the declarations of the Kubernetes CEL libraries
+// described at https://kubernetes.io/docs/reference/using-api/cel/.
+func k8sOptions() []cel.EnvOption {
+	var (
+		str      = types.StringType
+		boolean  = types.BoolType
+		integer  = types.IntType
+		double   = types.DoubleType
+		listOfT  = types.NewListType(types.NewTypeParamType("T"))
+		typeT    = types.NewTypeParamType("T")
+		strList  = types.NewListType(str)
+		queryMap = types.NewMapType(str, strList)
+	)
+	opts := []cel.EnvOption{
+		cel.OptionalTypes(),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(ext.StringsVersion(2)),
+		ext.Sets(),
+		ext.TwoVarComprehensions(),
+
+		// Lists.
+		member("isSorted", listOfT, boolean),
+		member("sum", listOfT, typeT),
+		member("min", listOfT, typeT),
+		member("max", listOfT, typeT),
+		member("indexOf", listOfT, integer, typeT),
+		member("lastIndexOf", listOfT, integer, typeT),
+
+		// Regular expressions.
+		member("find", str, str, str),
+		member("findAll", str, strList, str),
+		member("findAll", str, strList, str, integer),
+
+		// URLs.
+		global("url", k8sURL, str),
+		global("isURL", boolean, str),
+		member("getScheme", k8sURL, str),
+		member("getHost", k8sURL, str),
+		member("getHostname", k8sURL, str),
+		member("getPort", k8sURL, str),
+		member("getEscapedPath", k8sURL, str),
+		member("getQuery", k8sURL, queryMap),
+
+		// Quantities.
+		global("quantity", k8sQuantity, str),
+		global("isQuantity", boolean, str),
+		member("sign", k8sQuantity, integer),
+		member("isInteger", k8sQuantity, boolean),
+		member("asInteger", k8sQuantity, integer),
+		member("asApproximateFloat", k8sQuantity, double),
+		member("add", k8sQuantity, k8sQuantity, k8sQuantity),
+		member("add", k8sQuantity, k8sQuantity, integer),
+		member("sub", k8sQuantity, k8sQuantity, k8sQuantity),
+		member("sub", k8sQuantity, k8sQuantity, integer),
+		member("isGreaterThan", k8sQuantity, boolean, k8sQuantity),
+		member("isLessThan", k8sQuantity, boolean, k8sQuantity),
+		member("compareTo", k8sQuantity, integer, k8sQuantity),
+
+		// IP addresses and CIDR ranges.
+		global("ip", k8sIP, str),
+		global("isIP", boolean, str),
+		global("string", str, k8sIP),
+		member("family", k8sIP, integer),
+		member("isUnspecified", k8sIP, boolean),
+		member("isLoopback", k8sIP, boolean),
+		member("isLinkLocalMulticast", k8sIP, boolean),
+		member("isLinkLocalUnicast", k8sIP, boolean),
+		member("isGlobalUnicast", k8sIP, boolean),
+		global("cidr", k8sCIDR, str),
+		global("isCIDR", boolean, str),
+		global("string", str, k8sCIDR),
+		member("containsIP", k8sCIDR, boolean, k8sIP),
+		member("containsIP", k8sCIDR, boolean, str),
+		member("containsCIDR", k8sCIDR, boolean, k8sCIDR),
+		member("containsCIDR", k8sCIDR, boolean, str),
+		member("ip", k8sCIDR, k8sIP),
+		member("masked", k8sCIDR, k8sCIDR),
+		member("prefixLength", k8sCIDR, integer),
+
+		// Semantic versions.
+		global("semver", k8sSemver, str),
+		global("isSemver", boolean, str),
+		member("major", k8sSemver, integer),
+		member("minor", k8sSemver, integer),
+		member("patch", k8sSemver, integer),
+		member("isGreaterThan", k8sSemver, boolean, k8sSemver),
+		member("isLessThan", k8sSemver, boolean, k8sSemver),
+		member("compareTo", k8sSemver, integer, k8sSemver),
+
+		// Named formats.
+		global("format.named", types.NewOptionalType(k8sFormat), str),
+		member("validate", k8sFormat, types.NewOptionalType(strList), str),
+
+		// Authorization checks.
+		member("path", k8sAuthorizer, k8sPathCheck, str),
+		member("group", k8sAuthorizer, k8sGroupCheck, str),
+		member("serviceAccount", k8sAuthorizer, k8sAuthorizer, str, str),
+		member("resource", k8sGroupCheck, k8sResource, str),
+		member("subresource", k8sResource, k8sResource, str),
+		member("namespace", k8sResource, k8sResource, str),
+		member("name", k8sResource, k8sResource, str),
+		member("fieldSelector", k8sResource, k8sResource, str),
+		member("labelSelector", k8sResource, k8sResource, str),
+		member("check", k8sPathCheck, k8sDecision, str),
+		member("check", k8sResource, k8sDecision, str),
+		member("allowed", k8sDecision, boolean),
+		member("reason", k8sDecision, str),
+		member("errored", k8sDecision, boolean),
+		member("error", k8sDecision, str),
+	}
+	for _, name := range []string{"dns1123Label", "dns1123Subdomain", "dns1035Label", "qualifiedName", "dns1123LabelPrefix", "dns1123SubdomainPrefix", "dns1035LabelPrefix", "labelValue", "uri", "uuid", "byte", "date", "datetime"} {
+		opts = append(opts, global("format."+name, k8sFormat))
+	}
+	return opts
+}
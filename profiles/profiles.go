@@ -0,0 +1,133 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package profiles provides CEL environments for the dialects of CEL that
+// celfmt formats. Each profile declares the variables and functions that
+// programs in the dialect may use so that they can be type-checked. Only
+// declarations are provided; the environments cannot be used to evaluate
+// programs that call profile-specific functions.
+package profiles
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+
+	"github.com/elastic/celfmt/mitoenv"
+)
+
+// Profile names.
+const (
+	Mito          = "mito"          // mito and the Elastic Agent CEL input
+	K8s           = "k8s"           // Kubernetes validation and admission policies
+	CELStd        = "cel-std"       // cel-go with its ext libraries
+	Protovalidate = "protovalidate" // protovalidate rules
+)
+
+// profile is the construction of a profile's environment.
+type profile struct {
+	// vars returns the default variables of the profile.
+	vars func() []*decls.VariableDecl
+	// opts returns the environment options declaring the
+	// profile's functions.
+	opts func() []cel.EnvOption
+}
+
+var profiles = map[string]profile{
+	Mito:          {}, // built by mitoenv
+	K8s:           {vars: k8sVars, opts: k8sOptions},
+	CELStd:        {vars: func() []*decls.VariableDecl { return nil }, opts: celStdOptions},
+	Protovalidate: {vars: protovalidateVars, opts: protovalidateOptions},
+}
+
+// Names returns the names of the available profiles, in sorted order.
+func Names() []string {
+	return slices.Sorted(maps.Keys(profiles))
+}
+
+// New returns the CEL environment for the named profile with macro call
+// tracking enabled as required by celfmt.Format. If vars is not nil, it
+// replaces the profile's default variables. Any opts are applied after
+// the profile's declarations.
+func New(name string, vars []*decls.VariableDecl, opts ...cel.EnvOption) (*cel.Env, error) {
+	if name == Mito {
+		envOpts := []mitoenv.Option{mitoenv.EnvOptions(opts...)}
+		if vars != nil {
+			envOpts = append(envOpts, mitoenv.Variables(vars...))
+		}
+		env, err := mitoenv.New(envOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return env.Env, nil
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	if vars == nil {
+		vars = p.vars()
+	}
+	envOpts := []cel.EnvOption{cel.VariableDecls(vars...)}
+	envOpts = append(envOpts, p.opts()...)
+	envOpts = append(envOpts, cel.EnableMacroCallTracking())
+	return cel.NewEnv(append(envOpts, opts...)...)
+}
+
+func celStdOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.OptionalTypes(),
+		ext.Bindings(),
+		ext.Encoders(),
+		ext.Lists(),
+		ext.Math(),
+		ext.Protos(),
+		ext.Regex(),
+		ext.Sets(),
+		ext.Strings(),
+		ext.TwoVarComprehensions(),
+	}
+}
+
+// member returns a function declaration for a member function of recv
+// with the given argument and result types. The overload ID is derived
+// from the names of the types.
+func member(name string, recv *types.Type, result *types.Type, args ...*types.Type) cel.EnvOption {
+	return cel.Function(name, cel.MemberOverload(overloadID(name, recv, args), append([]*types.Type{recv}, args...), result))
+}
+
+// global returns a function declaration for a global function with the
+// given argument and result types.
+func global(name string, result *types.Type, args ...*types.Type) cel.EnvOption {
+	return cel.Function(name, cel.Overload(overloadID(name, nil, args), args, result))
+}
+
+func overloadID(name string, recv *types.Type, args []*types.Type) string {
+	id := name
+	if recv != nil {
+		id = recv.String() + "_" + id
+	}
+	for _, a := range args {
+		id += "_" + a.String()
+	}
+	return id
+}
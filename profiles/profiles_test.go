@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package profiles
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+)
+
+var newTests = []struct {
+	profile   string
+	vars      []*decls.VariableDecl
+	src       string
+	wantCheck string
+}{
+	{profile: Mito, src: `state.with({"ua": useragent, "now": now()})`},
+	{profile: Mito, src: `object.spec`, wantCheck: "undeclared reference to 'object'"},
+	{
+		profile: K8s,
+		src: `object.spec.replicas <= params.maxReplicas &&
+			object.spec.containers.all(c, c.image.find('^[a-z]+') != '' && isURL(c.registry)) &&
+			quantity(object.spec.memory).isLessThan(quantity('1Gi')) &&
+			cidr('10.0.0.0/8').containsIP(object.status.podIP) &&
+			[1, 2, 3].isSorted() && semver('1.2.3').major() == 1 &&
+			!format.dns1123Label().validate(object.metadata.name).hasValue() &&
+			authorizer.group('apps').resource('deployments').namespace('ns').check('create').allowed() &&
+			sets.contains('a,b'.split(','), ['a'])`,
+	},
+	{profile: K8s, src: `state.x`, wantCheck: "undeclared reference to 'state'"},
+	{profile: K8s, src: `now()`, wantCheck: "undeclared reference to 'now'"},
+	{
+		profile: CELStd,
+		vars:    []*decls.VariableDecl{decls.NewVariable("x", types.DynType)},
+		src: `cel.bind(s, 'a-b'.split('-'), s.join(',')) + base64.encode(b'x') +
+			string(math.greatest([1, 2])) + string(lists.range(2).sortBy(v, -v)[0]) +
+			string(regex.extract('ab', 'a(b)').orValue('')) + string(sets.intersects([1], [x]))`,
+	},
+	{profile: CELStd, src: `state`, wantCheck: "undeclared reference to 'state'"},
+	{
+		profile: Protovalidate,
+		src: `this.email.isEmail() && this.host.isHostAndPort(true) && this.ips.unique() &&
+			rules.const > 0.0 && !this.ratio.isNan() && this.created < now &&
+			getField(this, 'name') != ''`,
+	},
+	{profile: Protovalidate, src: `this.isURL()`, wantCheck: "undeclared reference to 'isURL'"},
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range newTests {
+		t.Run(test.profile, func(t *testing.T) {
+			env, err := New(test.profile, test.vars)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, iss := env.Compile(test.src)
+			if test.wantCheck != "" {
+				if iss.Err() == nil || !strings.Contains(iss.Err().Error(), test.wantCheck) {
+					t.Errorf("unexpected check result: got:%v want:%q", iss.Err(), test.wantCheck)
+				}
+				return
+			}
+			if iss.Err() != nil {
+				t.Errorf("unexpected check error: %v", iss.Err())
+			}
+		})
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+	_, err := New("nope", nil)
+	if err == nil || err.Error() != "unknown profile: nope" {
+		t.Errorf("unexpected error: got:%v want:unknown profile: nope", err)
+	}
+}
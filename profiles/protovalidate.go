@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package profiles
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+)
+
+// protovalidateVars returns the variables available to protovalidate
+// rule expressions.
+func protovalidateVars() []*decls.VariableDecl {
+	return []*decls.VariableDecl{
+		decls.NewVariable("this", types.DynType),
+		decls.NewVariable("rules", types.DynType),
+		decls.NewVariable("rule", types.DynType),
+		decls.NewVariable("now", types.TimestampType),
+	}
+}
+
+// protovalidateOptions returns the declarations of the protovalidate CEL
+// extensions described at https://protovalidate.com/reference/cel_extensions/.
+func protovalidateOptions() []cel.EnvOption {
+	var (
+		str     = types.StringType
+		boolean = types.BoolType
+		integer = types.IntType
+		double  = types.DoubleType
+		listOfT = types.NewListType(types.NewTypeParamType("T"))
+	)
+	return []cel.EnvOption{
+		cel.OptionalTypes(),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(ext.StringsValidateFormatCalls(true)),
+
+		member("isNan", double, boolean),
+		member("isInf", double, boolean),
+		member("isInf", double, boolean, integer),
+		member("isHostname", str, boolean),
+		member("isEmail", str, boolean),
+		member("isIp", str, boolean),
+		member("isIp", str, boolean, integer),
+		member("isIpPrefix", str, boolean),
+		member("isIpPrefix", str, boolean, integer),
+		member("isIpPrefix", str, boolean, boolean),
+		member("isIpPrefix", str, boolean, integer, boolean),
+		member("isUri", str, boolean),
+		member("isUriRef", str, boolean),
+		member("isHostAndPort", str, boolean, boolean),
+		member("unique", listOfT, boolean),
+		global("getField", types.DynType, types.DynType, str),
+	}
+}
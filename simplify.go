@@ -18,8 +18,6 @@
 package celfmt
 
 import (
-	"strings"
-
 	"github.com/google/cel-go/common"
 	"github.com/google/cel-go/common/ast"
 	"github.com/google/cel-go/common/operators"
@@ -31,16 +29,75 @@ import (
 //   - eliminate boolean comparisons (x == true → x, x == false → !x)
 //   - rewrite has(x.f) ? x.f : d and !has(x.f) ? d : x.f → x.?f.orValue(d)
 func Simplify(a *ast.AST, src common.Source) {
-	inlineAs(a)
-	elimBoolCmp(a)
-	elimHasTernary(a, src)
+	SimplifyReport(a, src)
+}
+
+// Simplification rules reported in Simplification.Rule.
+const (
+	RuleInlineAs   = "inline-as"   // a single-use .as() binding was inlined
+	RuleBoolCmp    = "bool-cmp"    // a comparison with a boolean literal was eliminated
+	RuleHasTernary = "has-ternary" // a has() ternary was rewritten to an optional field selection
+)
+
+// Simplification is a simplification applied by SimplifyReport.
+type Simplification struct {
+	Rule string
+
+	// Line and Column are the 1-based position of the simplified
+	// expression in the source. Columns count runes.
+	Line, Column int
+}
+
+// SimplifyReport applies the simplifications of Simplify to the AST and
+// returns the simplifications that were applied.
+// Expressions protected from formatting by directives are not simplified.
+func SimplifyReport(a *ast.AST, src common.Source) []Simplification {
+	return SimplifyComments(a, src, nil)
+}
+
+// SimplifyComments is like SimplifyReport, but also updates the comment map
+// m returned by NewCommentMap for the AST, so that the comments attached to
+// expressions that are replaced follow the expressions replacing them when
+// the AST is formatted with the Comments option.
+func SimplifyComments(a *ast.AST, src common.Source, m CommentMap) []Simplification {
+	text := lexSource(src.Content())
+	r := &simplifications{info: a.SourceInfo(), protect: newProtector(a, text), comments: m}
+	inlineAs(a, r)
+	elimBoolCmp(a, r)
+	elimHasTernary(a, text, r)
+	return r.applied
+}
+
+// simplifications records the simplifications applied to an AST, and
+// updates comments, if not nil, as expressions are replaced.
+type simplifications struct {
+	info     *ast.SourceInfo
+	protect  *protector
+	comments CommentMap
+	applied  []Simplification
+}
+
+// protected returns whether any part of the expression e is protected
+// from formatting by a directive.
+func (s *simplifications) protected(e ast.Expr) bool {
+	return s.protect != nil && s.protect.overlaps(e)
+}
+
+// add records the application of rule to the expression with the given ID.
+func (s *simplifications) add(rule string, id int64) {
+	loc := s.info.GetStartLocation(id)
+	s.applied = append(s.applied, Simplification{
+		Rule:   rule,
+		Line:   loc.Line(),
+		Column: loc.Column() + 1,
+	})
 }
 
 // inlineAs finds .as() macro calls where the bound variable is used at most
 // once in the result expression, and replaces the comprehension with its
 // result (substituting the init expression for the single use). Zero-use
 // bindings are replaced with the bare result.
-func inlineAs(a *ast.AST) {
+func inlineAs(a *ast.AST, r *simplifications) {
 	info := a.SourceInfo()
 	// Each inlining mutates the macro call map (clear, set, clear), so
 	// restart iteration after every change to avoid depending on Go's
@@ -60,7 +117,7 @@ func inlineAs(a *ast.AST) {
 					comp = e
 				}
 			}))
-			if comp == nil || comp.Kind() != ast.ComprehensionKind {
+			if comp == nil || comp.Kind() != ast.ComprehensionKind || r.protected(comp) {
 				continue
 			}
 			c := comp.AsComprehension()
@@ -73,9 +130,22 @@ func inlineAs(a *ast.AST) {
 				continue
 			}
 
+			r.add(RuleInlineAs, id)
+			// The comments of the init expression follow it to
+			// its use, or to the result if it is unused, and
+			// those of the variable and the result are moved to
+			// the comprehension, which becomes the result.
 			if n == 1 {
-				substituteIdent(result, name, init)
+				for _, use := range substituteIdent(result, name, init) {
+					r.comments.Update(init.ID(), use)
+				}
+			} else {
+				r.comments.Update(init.ID(), comp.ID())
 			}
+			if args := call.AsCall().Args(); len(args) == 2 {
+				r.comments.Update(args[0].ID(), comp.ID())
+			}
+			r.comments.Update(result.ID(), comp.ID())
 
 			// Clear the outer .as() macro entry before any remap so we
 			// don't clobber a remapped inner entry that lands on the
@@ -116,17 +186,21 @@ func countIdent(expr ast.Expr, ident string) int {
 	return n
 }
 
-// substituteIdent replaces all IdentKind nodes named ident with replacement.
-func substituteIdent(expr ast.Expr, ident string, replacement ast.Expr) {
+// substituteIdent replaces all IdentKind nodes named ident with replacement,
+// and returns the IDs of the nodes replaced.
+func substituteIdent(expr ast.Expr, ident string, replacement ast.Expr) []int64 {
+	var ids []int64
 	ast.PreOrderVisit(expr, ast.NewExprVisitor(func(e ast.Expr) {
 		if e.Kind() == ast.IdentKind && e.AsIdent() == ident {
 			e.SetKindCase(replacement)
+			ids = append(ids, e.ID())
 		}
 	}))
+	return ids
 }
 
 // elimBoolCmp rewrites x == true → x and x == false → !x.
-func elimBoolCmp(a *ast.AST) {
+func elimBoolCmp(a *ast.AST, r *simplifications) {
 	fac := ast.NewExprFactory()
 	ast.PreOrderVisit(a.Expr(), ast.NewExprVisitor(func(e ast.Expr) {
 		if e.Kind() != ast.CallKind {
@@ -142,10 +216,20 @@ func elimBoolCmp(a *ast.AST) {
 		}
 		lhs, rhs := args[0], args[1]
 		val, other, ok := boolLiteralOperand(lhs, rhs)
-		if !ok {
+		if !ok || r.protected(e) {
 			return
 		}
+		r.add(RuleBoolCmp, e.ID())
+		// The comments of the literal, and those of the other
+		// operand if it takes the place of the comparison, are
+		// moved to the comparison.
+		lit := lhs
+		if lit == other {
+			lit = rhs
+		}
+		r.comments.Update(lit.ID(), e.ID())
 		if val {
+			r.comments.Update(other.ID(), e.ID())
 			e.SetKindCase(other)
 		} else {
 			neg := fac.NewCall(e.ID(), operators.LogicalNot, other)
@@ -184,7 +268,7 @@ func asBool(e ast.Expr) (bool, bool) {
 // and !has(x.f) ? d : x.f → x.?f.orValue(d). The rewrite is skipped
 // when the field-access branch has preceding comments, since the
 // simplified form has no position to attach them.
-func elimHasTernary(a *ast.AST, src common.Source) {
+func elimHasTernary(a *ast.AST, text *sourceText, r *simplifications) {
 	info := a.SourceInfo()
 	fac := ast.NewExprFactory()
 	ast.PreOrderVisit(a.Expr(), ast.NewExprVisitor(func(e ast.Expr) {
@@ -204,9 +288,16 @@ func elimHasTernary(a *ast.AST, src common.Source) {
 		if hasSel == nil {
 			return
 		}
-		if hasComment(src, info, access.ID()) {
+		if hasComment(text, info, access.ID()) || r.protected(e) {
 			return
 		}
+		r.add(RuleHasTernary, e.ID())
+		// The comments of the condition and of the field access,
+		// whose ID is reused for the field name, are moved to
+		// the ternary, which becomes the orValue call.
+		r.comments.Update(args[0].ID(), e.ID())
+		r.comments.Update(hasSel.ID(), e.ID())
+		r.comments.Update(access.ID(), e.ID())
 
 		sel := hasSel.AsSelect()
 		optSel := fac.NewCall(hasSel.ID(), operators.OptSelect,
@@ -220,18 +311,17 @@ func elimHasTernary(a *ast.AST, src common.Source) {
 
 // hasComment reports whether there are comment lines immediately preceding
 // the expression with the given ID in the source text.
-func hasComment(src common.Source, info *ast.SourceInfo, id int64) bool {
+func hasComment(text *sourceText, info *ast.SourceInfo, id int64) bool {
 	start := info.GetStartLocation(id)
 	for line := start.Line() - 1; line > 0; line-- {
-		text, ok := src.Snippet(line)
-		if !ok {
-			return false
-		}
-		trimmed := strings.TrimSpace(text)
-		if trimmed == "" {
+		switch text.lineKind(line) {
+		case blankLine:
 			continue
+		case commentLine:
+			return true
+		default:
+			return false
 		}
-		return strings.HasPrefix(trimmed, "//")
 	}
 	return false
 }
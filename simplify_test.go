@@ -18,6 +18,7 @@
 package celfmt
 
 import (
+	"slices"
 	"strings"
 	"testing"
 
@@ -66,6 +67,14 @@ func TestSimplify(t *testing.T) {
 			want: "has(x.f) ?\n\t// keep this\n\tx.f\n:\n\t0",
 			opts: []FormatOption{Pretty()},
 		},
+		{
+			// A trailing comment that comes to be within a
+			// call breaks it.
+			name: "has_ternary_trailing_comment",
+			in:   "{\n\t\"a\": has(x.f) ? x.f : \"d\", // trailing\n}",
+			want: "{\n\t\"a\": x.?f.orValue(\n\t\t\"d\" // trailing\n\t)\n}",
+			opts: []FormatOption{Pretty()},
+		},
 	}
 
 	env := newTestEnv(t)
@@ -91,6 +100,68 @@ func TestSimplify(t *testing.T) {
 	}
 }
 
+func TestSimplifyComments(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "bool_cmp",
+			in:   "[\n  x == true, // compared\n  y,\n]",
+			want: "[\n  x, // compared\n  y,\n]",
+		},
+		{
+			name: "bool_cmp_operand",
+			in:   "x == true && // why\n  y",
+			want: "x && // why\ny",
+		},
+		{
+			name: "as_init",
+			in:   "[\n  x // init\n    .as(v, v.size()),\n]",
+			want: "[\n  x // init\n    .size(),\n]",
+		},
+		{
+			name: "as_result",
+			in:   "[\n  x.as(v, v + 1), // inlined\n  y,\n]",
+			want: "[\n  x + 1, // inlined\n  y,\n]",
+		},
+		{
+			name: "has_ternary",
+			in:   "{\n  \"a\": has(x.f) ? x.f : \"d\", // defaulted\n}",
+			want: "{\n  \"a\": x.?f.orValue(\"d\"), // defaulted\n}",
+		},
+	}
+
+	env := newTestEnv(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, iss := env.Parse(tt.in)
+			if iss.Err() != nil {
+				t.Fatalf("Parse(%q): %v", tt.in, iss.Err())
+			}
+			native := parsed.NativeRep()
+			src := common.NewTextSource(tt.in)
+			m := NewCommentMap(native, src)
+			SimplifyComments(native, src, m)
+			var (
+				buf     strings.Builder
+				dropped []DroppedComment
+			)
+			err := Format(&buf, native, src, Pretty(), AlwaysComma(), IndentString("  "), Comments(m), DroppedComments(&dropped))
+			if err != nil {
+				t.Fatalf("Format() after SimplifyComments(%q): %v", tt.in, err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("SimplifyComments(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(dropped) != 0 {
+				t.Errorf("unexpected dropped comments: %+v", dropped)
+			}
+		})
+	}
+}
+
 func newTestEnv(t *testing.T) *cel.Env {
 	t.Helper()
 	env, err := cel.NewEnv(
@@ -109,3 +180,43 @@ func newTestEnv(t *testing.T) *cel.Env {
 	}
 	return env
 }
+
+func TestSimplifyReport(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []Simplification
+	}{
+		{name: "none", in: `x + 1`},
+		{
+			name: "all",
+			in:   "x.as(v, v > 1) == true ||\n  (has(y.f) ? y.f : 0) > 1",
+			want: []Simplification{
+				{Rule: RuleInlineAs, Line: 1, Column: 5},
+				{Rule: RuleBoolCmp, Line: 1, Column: 16},
+				{Rule: RuleHasTernary, Line: 2, Column: 13},
+			},
+		},
+		{
+			name: "protected",
+			in:   "[\n  // celfmt:ignore\n  x == true,\n  y == true,\n  // celfmt:off\n  x.as(v, v == true),\n]",
+			want: []Simplification{
+				{Rule: RuleBoolCmp, Line: 4, Column: 5},
+			},
+		},
+	}
+
+	env := newTestEnv(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compiled, iss := env.Compile(tt.in)
+			if iss != nil {
+				t.Fatalf("Compile(%q): %v", tt.in, iss)
+			}
+			got := SimplifyReport(compiled.NativeRep(), common.NewTextSource(tt.in))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SimplifyReport(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
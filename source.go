@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+)
+
+// Options configures FormatSource and Formatter.
+type Options struct {
+	// Declarations describes the environment programs are parsed and,
+	// if Check or the declarations' Check is true, type-checked in. If
+	// nil, DefaultDeclarations is used.
+	Declarations *Declarations
+
+	// EnvOptions are applied to the environment after the
+	// declarations, for example to declare additional variables.
+	EnvOptions []cel.EnvOption
+
+	// Check specifies that programs must type-check in the
+	// environment. Otherwise programs only need to parse.
+	Check bool
+
+	// Simplify specifies that programs are simplified with Simplify
+	// before they are formatted.
+	Simplify bool
+
+	// Format holds the options passed to Format.
+	Format []FormatOption
+}
+
+// Formatter formats CEL source text. The environment is built once when
+// the Formatter is created and reused by each call to Format. A Formatter
+// is safe for concurrent use.
+type Formatter struct {
+	env      *cel.Env
+	check    bool
+	simplify bool
+	format   []FormatOption
+}
+
+// NewFormatter returns a Formatter configured by opts. It returns an error
+// if the environment cannot be built or the format options are invalid.
+func NewFormatter(opts Options) (*Formatter, error) {
+	err := ValidateOptions(opts.Format...)
+	if err != nil {
+		return nil, err
+	}
+	d := opts.Declarations
+	if d == nil {
+		d = DefaultDeclarations()
+	}
+	env, err := d.NewEnv(opts.EnvOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create env: %w", err)
+	}
+	return &Formatter{
+		env:      env,
+		check:    opts.Check || d.Check,
+		simplify: opts.Simplify,
+		format:   opts.Format,
+	}, nil
+}
+
+// Format returns the formatted text of the CEL program in src. Errors
+// in the program are returned as an *Error, or when there are several, as
+// errors joined by errors.Join.
+func (f *Formatter) Format(src string) (string, error) {
+	formatted, _, err := f.FormatReport(src)
+	return formatted, err
+}
+
+// Report describes a program formatted by FormatReport.
+type Report struct {
+	// Simplifications holds the simplifications that were applied
+	// to the program if the Formatter simplifies programs.
+	Simplifications []Simplification
+
+	// DroppedComments holds the comments in the program that could
+	// not be placed in the formatted text when pretty printing.
+	DroppedComments []DroppedComment
+}
+
+// FormatReport is like Format, but also returns a report of the changes
+// made to the program. Comments that could not be placed are reported
+// rather than returned as errors unless the StrictComments option is used.
+func (f *Formatter) FormatReport(src string) (string, Report, error) {
+	var r Report
+	parsed, iss := f.env.Parse(src)
+	if iss.Err() != nil {
+		return "", r, issuesError(ParseError, iss)
+	}
+	if f.check {
+		_, iss = f.env.Check(parsed)
+		if iss.Err() != nil {
+			return "", r, issuesError(CheckError, iss)
+		}
+	}
+	textSrc := common.NewTextSource(src)
+	opts := append(slices.Clip(f.format), DroppedComments(&r.DroppedComments))
+	if f.simplify {
+		// The comments are attached to the expressions before
+		// they are rewritten so that they follow the expressions
+		// that replace them.
+		m := NewCommentMap(parsed.NativeRep(), textSrc)
+		r.Simplifications = SimplifyComments(parsed.NativeRep(), textSrc, m)
+		if len(r.Simplifications) != 0 {
+			opts = append(opts, Comments(m))
+		}
+	}
+	var buf strings.Builder
+	err := Format(&buf, parsed.NativeRep(), textSrc, opts...)
+	if err != nil {
+		return "", r, err
+	}
+	return buf.String(), r, nil
+}
+
+// FormatSource returns the formatted text of the CEL program in src. It is
+// a convenience for formatting a single program; use a Formatter to format
+// many programs with the same options.
+func FormatSource(src string, opts Options) (string, error) {
+	f, err := NewFormatter(opts)
+	if err != nil {
+		return "", err
+	}
+	return f.Format(src)
+}
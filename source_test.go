@@ -0,0 +1,171 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package celfmt
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+)
+
+var formatSourceTests = []struct {
+	name     string
+	src      string
+	opts     Options
+	want     string
+	wantKind ErrorKind
+	wantErr  string
+}{
+	{
+		name: "macros",
+		src:  `[1,2].map(x,x*2).filter(y,y>2)`,
+		want: `[1, 2].map(x, x * 2).filter(y, y > 2)`,
+	},
+	{
+		name: "pretty",
+		src:  "{\"a\":1,\n\"b\":[1,2]}",
+		opts: Options{Format: []FormatOption{Pretty(), AlwaysComma(), IndentString("  ")}},
+		want: "{\n  \"a\": 1,\n  \"b\": [1, 2],\n}",
+	},
+	{
+		name: "simplify",
+		src:  `state.a == true`,
+		opts: Options{Simplify: true},
+		want: `state.a`,
+	},
+	{
+		name: "undeclared_unchecked",
+		src:  `undeclared(state)`,
+		want: `undeclared(state)`,
+	},
+	{
+		name:     "undeclared_checked",
+		src:      `undeclared(state)`,
+		opts:     Options{Check: true},
+		wantKind: CheckError,
+		wantErr:  "1:11: failed to check program: undeclared reference to 'undeclared' (in container '')",
+	},
+	{
+		// Declarations may require checking, as they do for the
+		// command and the wasm module.
+		name:     "undeclared_declarations_check",
+		src:      `undeclared(state)`,
+		opts:     Options{Declarations: &Declarations{Check: true}},
+		wantKind: CheckError,
+		wantErr:  "1:11: failed to check program: undeclared reference to 'undeclared' (in container '')",
+	},
+	{
+		name: "env_options",
+		src:  `extra + useragent`,
+		opts: Options{Check: true, EnvOptions: []cel.EnvOption{cel.Variable("extra", cel.StringType)}},
+		want: `extra + useragent`,
+	},
+	{
+		name: "profile",
+		src:  `isURL(object.url)`,
+		opts: Options{Check: true, Declarations: &Declarations{Profile: "k8s"}},
+		want: `isURL(object.url)`,
+	},
+	{
+		name:     "syntax",
+		src:      `state.`,
+		wantKind: ParseError,
+		wantErr:  "1:7: failed to parse program: Syntax error: no viable alternative at input '.'",
+	},
+	{
+		name:     "multiple",
+		src:      "state.a +\n  b + c",
+		opts:     Options{Check: true},
+		wantKind: CheckError,
+		wantErr:  "2:3: failed to check program: undeclared reference to 'b' (in container '')\n2:7: failed to check program: undeclared reference to 'c' (in container '')",
+	},
+	{
+		name:    "invalid_option",
+		src:     `state`,
+		opts:    Options{Format: []FormatOption{WrapOnColumn(0)}},
+		wantErr: "Invalid unparser option. Wrap column value must be greater than or equal to 1. Got 0 instead",
+	},
+}
+
+func TestFormatSource(t *testing.T) {
+	for _, test := range formatSourceTests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FormatSource(test.src, test.opts)
+			if err != nil {
+				if err.Error() != test.wantErr {
+					t.Fatalf("unexpected error: got:%q want:%q", err, test.wantErr)
+				}
+				var e *Error
+				if errors.As(err, &e) != (test.wantKind != 0) || (e != nil && e.Kind != test.wantKind) {
+					t.Errorf("unexpected error kind: got:%#v want:%v", err, test.wantKind)
+				}
+				return
+			}
+			if test.wantErr != "" {
+				t.Fatalf("expected error: %q", test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("unexpected result:\ngot: %q\nwant:%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatterConcurrent(t *testing.T) {
+	f, err := NewFormatter(Options{Check: true, Format: []FormatOption{Pretty()}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const want = `state.with({"n": state.n + 1})`
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			got, err := f.Format(`state.with({"n":state.n+1})`)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if got != want {
+				t.Errorf("unexpected result: got:%q want:%q", got, want)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestFormatReport(t *testing.T) {
+	f, err := NewFormatter(Options{Simplify: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, report, err := f.FormatReport("state.a &&\n  state.b == false")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const want = "state.a && !state.b"
+	if got != want {
+		t.Errorf("unexpected result:\ngot: %q\nwant:%q", got, want)
+	}
+	wantApplied := []Simplification{{Rule: RuleBoolCmp, Line: 2, Column: 11}}
+	if !slices.Equal(report.Simplifications, wantApplied) {
+		t.Errorf("unexpected simplifications: got:%+v want:%+v", report.Simplifications, wantApplied)
+	}
+}